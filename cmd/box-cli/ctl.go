@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var pidPathFlag = cli.StringFlag{
+	Name:  "pid-path",
+	Usage: "pid file of the master, the address is read from xx.pid.addr",
+}
+
+var ctlFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "master-addr",
+		Usage: "master address, e.g. 127.0.0.1:9012",
+	},
+	pidPathFlag,
+	cli.StringFlag{
+		Name:   "token",
+		Usage:  "token of the master control API",
+		EnvVar: "BOX_CTL_TOKEN",
+	},
+}
+
+var ctlCommand = cli.Command{
+	Name:      "ctl",
+	Usage:     "control a running master",
+	UsageText: "box-cli ctl status|pid|crashes|reload|restart|stop|reopen [arguments...]",
+	Subcommands: []cli.Command{
+		{
+			Name:   "pid",
+			Usage:  "print the pid of the running master, exit 1 if it is not running",
+			Flags:  []cli.Flag{pidPathFlag},
+			Action: ctlPID,
+		},
+		{
+			Name:   "status",
+			Usage:  "list the workers",
+			Flags:  ctlFlags,
+			Action: ctlStatus,
+		},
+		{
+			Name:  "crashes",
+			Usage: "show the last output lines of the latest crashed workers",
+			Flags: append(ctlFlags, cli.IntFlag{
+				Name:  "lines, n",
+				Usage: "lines per worker, 0 means all the lines kept",
+				Value: 20,
+			}),
+			Action: ctlCrashes,
+		},
+		{
+			Name:   "reload",
+			Usage:  "fork new workers and retire the old ones",
+			Flags:  ctlFlags,
+			Action: ctlAction("/ctl/reload"),
+		},
+		{
+			Name:      "restart",
+			Usage:     "replace a single worker",
+			UsageText: "box-cli ctl restart [arguments...] pid",
+			Flags:     ctlFlags,
+			Action:    ctlRestart,
+		},
+		{
+			Name:  "stop",
+			Usage: "stop the master and its workers gracefully",
+			Flags: append(ctlFlags, cli.DurationFlag{
+				Name:  "wait",
+				Usage: "wait until the pid file is unlocked, e.g. 60s",
+			}),
+			Action: ctlStop,
+		},
+		{
+			Name:   "reopen",
+			Usage:  "reopen the log files",
+			Flags:  ctlFlags,
+			Action: ctlAction("/ctl/reopen"),
+		},
+	},
+}
+
+type ctlWorker struct {
+	Pid      int    `json:"pid"`
+	Slot     int    `json:"slot"`
+	State    string `json:"state"`
+	Restarts int    `json:"restarts"`
+	Uptime   string `json:"uptime"`
+	LastExit string `json:"lastExit"`
+}
+
+type ctlCrash struct {
+	Pid   int      `json:"pid"`
+	Slot  int      `json:"slot"`
+	Gen   int      `json:"gen"`
+	Exit  string   `json:"exit"`
+	Time  string   `json:"time"`
+	Lines []string `json:"lines"`
+}
+
+type ctlRsp struct {
+	Code    int         `json:"code"`
+	Msg     string      `json:"msg"`
+	Pid     int         `json:"pid"`
+	Workers []ctlWorker `json:"workers"`
+	Crashes []ctlCrash  `json:"crashes"`
+}
+
+// masterAddr returns --master-addr, or the address saved next to the pid
+// file of a running master.
+func masterAddr(ctx *cli.Context) (string, error) {
+	if addr := ctx.String("master-addr"); addr != "" {
+		return addr, nil
+	}
+	pidPath := ctx.String("pid-path")
+	if pidPath == "" {
+		return "", errors.New("either --master-addr or --pid-path is required")
+	}
+	if _, err := masterPID(pidPath); err != nil {
+		return "", err
+	}
+	addr, err := ioutil.ReadFile(pidPath + ".addr")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(addr)), nil
+}
+
+// masterPID returns the pid of the master holding the lock of pidPath. A
+// pid file which is not locked is stale.
+func masterPID(pidPath string) (int, error) {
+	f, err := os.Open(pidPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid file %s", pidPath)
+	}
+	switch err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err {
+	case syscall.EWOULDBLOCK:
+		return pid, nil
+	case nil:
+		return 0, fmt.Errorf("master %d is not running, stale pid file %s",
+			pid, pidPath)
+	default:
+		return 0, err
+	}
+}
+
+func ctlPID(ctx *cli.Context) error {
+	pidPath := ctx.String("pid-path")
+	if pidPath == "" {
+		return cli.NewExitError("--pid-path is required", 1)
+	}
+	pid, err := masterPID(pidPath)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Println(pid)
+	return nil
+}
+
+func ctlStop(ctx *cli.Context) error {
+	if err := ctlAction("/ctl/stop")(ctx); err != nil {
+		return err
+	}
+	wait := ctx.Duration("wait")
+	pidPath := ctx.String("pid-path")
+	if wait <= 0 || pidPath == "" {
+		return nil
+	}
+	for start := time.Now(); time.Since(start) < wait; {
+		if _, err := masterPID(pidPath); err != nil {
+			fmt.Println("stopped")
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return cli.NewExitError("master is still running after "+wait.String(), 1)
+}
+
+func ctlRequest(ctx *cli.Context, method, path string) (*ctlRsp, error) {
+	addr, err := masterAddr(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, "http://"+addr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := ctx.String("token"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	c := &http.Client{Timeout: 5 * time.Second}
+	rsp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	r := &ctlRsp{}
+	if err := json.NewDecoder(rsp.Body).Decode(r); err != nil {
+		return nil, fmt.Errorf("%s: %s", rsp.Status, err)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", rsp.Status, r.Msg)
+	}
+	return r, nil
+}
+
+func ctlAction(path string) func(*cli.Context) error {
+	return func(ctx *cli.Context) error {
+		r, err := ctlRequest(ctx, "POST", path)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		fmt.Printf("master %d: %s\n", r.Pid, r.Msg)
+		return nil
+	}
+}
+
+func ctlRestart(ctx *cli.Context) error {
+	pid, err := strconv.Atoi(ctx.Args().First())
+	if err != nil {
+		return cli.NewExitError("usage: "+ctx.Command.UsageText, 1)
+	}
+	return ctlAction("/ctl/restart?pid=" + strconv.Itoa(pid))(ctx)
+}
+
+func ctlStatus(ctx *cli.Context) error {
+	r, err := ctlRequest(ctx, "GET", "/ctl/workers")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Printf("master %d\n", r.Pid)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PID\tSLOT\tSTATE\tUPTIME\tRESTARTS\tLAST EXIT")
+	for _, worker := range r.Workers {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%d\t%s\n", worker.Pid, worker.Slot,
+			worker.State, worker.Uptime, worker.Restarts, worker.LastExit)
+	}
+	return w.Flush()
+}
+
+func ctlCrashes(ctx *cli.Context) error {
+	path := "/ctl/crashes?lines=" + strconv.Itoa(ctx.Int("lines"))
+	r, err := ctlRequest(ctx, "GET", path)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if len(r.Crashes) == 0 {
+		fmt.Printf("master %d: no crashed worker\n", r.Pid)
+		return nil
+	}
+	for _, c := range r.Crashes {
+		fmt.Printf("==> worker %d slot %d gen %d, %s at %s\n",
+			c.Pid, c.Slot, c.Gen, c.Exit, c.Time)
+		for _, line := range c.Lines {
+			fmt.Println(line)
+		}
+	}
+	return nil
+}
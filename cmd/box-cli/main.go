@@ -217,6 +217,7 @@ func main() {
 				},
 			},
 		},
+		ctlCommand,
 	}
 	err := app.Run(os.Args)
 	if err != nil {
@@ -144,9 +144,29 @@ func (h *http) generateService(file *generator.FileDescriptor, service *pb.Servi
 		if method.GetServerStreaming() || method.GetClientStreaming() {
 			continue
 		}
-		pattern := fmt.Sprintf("pattern_%s_%s",
-			servName, method.GetName())
-		h.P(strconv.Quote(method.GetName()), ": ", pattern, ",")
+		h.P(strconv.Quote(method.GetName()), ": ",
+			patternName(servName, method, 0), ",")
+	}
+	h.P("},")
+	h.P("Rules: map[string][]", trhttpPkg, ".Rule{")
+	for _, method := range service.Method {
+		if method.GetServerStreaming() || method.GetClientStreaming() {
+			continue
+		}
+		h.P(strconv.Quote(method.GetName()), ": {")
+		for i, b := range bindings(fullServName, method) {
+			rule := "Method: " + strconv.Quote(b.method) +
+				", Path: " + strconv.Quote(b.path)
+			if b.body != "" {
+				rule += ", Body: " + strconv.Quote(b.body)
+			}
+			if b.responseBody != "" {
+				rule += ", ResponseBody: " + strconv.Quote(b.responseBody)
+			}
+			h.P("{HTTPRule: ", troptPkg, ".HTTPRule{", rule, "}, ",
+				"Pattern: ", patternName(servName, method, i), "},")
+		}
+		h.P("},")
 	}
 	h.P("},")
 	h.P("}")
@@ -169,24 +189,89 @@ func (h *http) generateService(file *generator.FileDescriptor, service *pb.Servi
 
 	h.P("var (")
 	for _, method := range service.Method {
-		ext, _ := proto.GetExtension(method.Options, options.E_Http)
-		opts, _ := ext.(*options.HttpRule)
-		pathTemplate := opts.GetPost()
-		parsed, _ := httprule.Parse(pathTemplate)
-		tmpl := parsed.Compile()
-		pattern := fmt.Sprintf("pattern_%s_%s",
-			servName, method.GetName())
-		h.P(pattern, " = ", runtimePkg, ".MustPattern(",
-			runtimePkg, ".NewPattern(", tmpl.Version, ", ",
-			fmt.Sprintf("%#v", tmpl.OpCodes), ", ",
-			fmt.Sprintf("%#v", tmpl.Pool), ", ",
-			`""))`,
-		)
+		if method.GetServerStreaming() || method.GetClientStreaming() {
+			continue
+		}
+		for i, b := range bindings(fullServName, method) {
+			parsed, err := httprule.Parse(b.path)
+			if err != nil {
+				h.gen.Fail("invalid path template of", method.GetName(),
+					err.Error())
+			}
+			tmpl := parsed.Compile()
+			h.P(patternName(servName, method, i), " = ",
+				runtimePkg, ".MustPattern(",
+				runtimePkg, ".NewPattern(", tmpl.Version, ", ",
+				fmt.Sprintf("%#v", tmpl.OpCodes), ", ",
+				fmt.Sprintf("%#v", tmpl.Pool), ", ",
+				strconv.Quote(tmpl.Verb), "))",
+			)
+		}
 	}
 	h.P(")")
 	h.P()
 }
 
+// patternName names the pattern of the i-th binding of method. The names
+// differ from those of grpc-gateway, which may be generated in the package.
+func patternName(servName string, method *pb.MethodDescriptorProto,
+	i int) string {
+
+	if i == 0 {
+		return fmt.Sprintf("pattern_%s_%s", servName, method.GetName())
+	}
+	return fmt.Sprintf("pattern_%s_%s_Binding%d", servName, method.GetName(), i)
+}
+
+// binding is a google.api.http rule of a method.
+type binding struct {
+	method       string
+	path         string
+	body         string
+	responseBody string
+}
+
+// bindings returns the google.api.http rule of method and its
+// additional_bindings. A method without one is POSTed to
+// /package.Service/Method.
+func bindings(fullServName string,
+	method *pb.MethodDescriptorProto) []binding {
+
+	ext, err := proto.GetExtension(method.Options, options.E_Http)
+	rule, _ := ext.(*options.HttpRule)
+	if err != nil || rule == nil {
+		return []binding{{
+			method: "POST",
+			path:   "/" + fullServName + "/" + method.GetName(),
+			body:   "*",
+		}}
+	}
+	bs := []binding{newBinding(rule)}
+	for _, r := range rule.GetAdditionalBindings() {
+		bs = append(bs, newBinding(r))
+	}
+	return bs
+}
+
+func newBinding(rule *options.HttpRule) binding {
+	b := binding{body: rule.GetBody(), responseBody: rule.GetResponseBody()}
+	switch p := rule.GetPattern().(type) {
+	case *options.HttpRule_Get:
+		b.method, b.path = "GET", p.Get
+	case *options.HttpRule_Put:
+		b.method, b.path = "PUT", p.Put
+	case *options.HttpRule_Post:
+		b.method, b.path = "POST", p.Post
+	case *options.HttpRule_Delete:
+		b.method, b.path = "DELETE", p.Delete
+	case *options.HttpRule_Patch:
+		b.method, b.path = "PATCH", p.Patch
+	case *options.HttpRule_Custom:
+		b.method, b.path = p.Custom.GetKind(), p.Custom.GetPath()
+	}
+	return b
+}
+
 // generateClientSignature returns the client-side signature for a method.
 func (h *http) generateClientSignature(servName string,
 	method *pb.MethodDescriptorProto) string {
@@ -218,9 +303,11 @@ func (h *http) generateClientMethod(servName string, fullServName string,
 		h.generateClientSignature(servName, method), "{")
 	if !method.GetServerStreaming() && !method.GetClientStreaming() {
 		h.P("out := new(", outType, ")")
-		h.P("pattern := ", serviceDescVar, ".Pattern[",
-			strconv.Quote(method.GetName()), "]")
-		h.P("err := c.cc.Invoke(ctx, pattern.String(), in, out, opts...)")
+		h.P("rule := ", serviceDescVar, ".Rules[",
+			strconv.Quote(method.GetName()), "][0]")
+		h.P("opts = append([]", troptPkg, ".CallOption{", troptPkg,
+			".WithHTTPRule(&rule.HTTPRule)}, opts...)")
+		h.P("err := c.cc.Invoke(ctx, rule.Path, in, out, opts...)")
 		h.P("if err != nil { return nil, err }")
 		h.P("return out, nil")
 		h.P("}")
@@ -31,24 +31,31 @@ func New(ec *etcd.Client, key string, opts ...Option) *ConfCenter {
 	}
 }
 
-func (c *ConfCenter) MakeConf(conf interface{}) error {
+// Fetch returns the raw config stored in etcd.
+func (c *ConfCenter) Fetch() ([]byte, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), c.opt.timeout)
 	defer cancel()
 
-	var confBytes []byte
-	if rsp, err := c.ec.Get(ctx, c.key); err != nil {
+	rsp, err := c.ec.Get(ctx, c.key)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(rsp.Kvs) == 0 || rsp.Kvs[0].Value == nil {
+		log.Error("empty config.")
+		return nil, errors.New("empty config")
+	}
+	return rsp.Kvs[0].Value, nil
+}
+
+func (c *ConfCenter) MakeConf(conf interface{}) error {
+	confBytes, err := c.Fetch()
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(confBytes, conf); err != nil {
 		log.Error(err)
 		return err
-	} else {
-		if len(rsp.Kvs) == 0 || rsp.Kvs[0].Value == nil {
-			log.Error("empty config.")
-			return errors.New("empty config")
-		}
-		confBytes = rsp.Kvs[0].Value
-		if err := yaml.Unmarshal(confBytes, conf); err != nil {
-			log.Error(err)
-			return err
-		}
 	}
 	if c.opt.savePath != "" {
 		file, err := os.OpenFile(c.opt.savePath,
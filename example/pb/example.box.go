@@ -170,8 +170,9 @@ func NewExampleHttpClient(cc tr1.ClientConn) ExampleHttpClient {
 
 func (c *exampleHttpClient) Echo(ctx context1.Context, in *EchoRequest, opts ...tropt1.CallOption) (*EchoReply, error) {
 	out := new(EchoReply)
-	pattern := _Example_Http_serviceDesc.Pattern["Echo"]
-	err := c.cc.Invoke(ctx, pattern.String(), in, out, opts...)
+	rule := _Example_Http_serviceDesc.Rules["Echo"][0]
+	opts = append([]tropt1.CallOption{tropt1.WithHTTPRule(&rule.HTTPRule)}, opts...)
+	err := c.cc.Invoke(ctx, rule.Path, in, out, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -183,6 +184,11 @@ var _Example_Http_serviceDesc = trhttp.ServiceDesc{
 	Pattern: map[string]runtime.Pattern{
 		"Echo": pattern_Example_Echo,
 	},
+	Rules: map[string][]trhttp.Rule{
+		"Echo": {
+			{HTTPRule: tropt1.HTTPRule{Method: "POST", Path: "/echo", Body: "*"}, Pattern: pattern_Example_Echo},
+		},
+	},
 }
 
 type exampleHttpServiceDesc struct {
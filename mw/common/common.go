@@ -1,5 +1,8 @@
 package common
 
 const (
-	FORK = "box-fork"
+	FORK    = "box-fork"
+	UPGRADE = "box-upgrade"
+	NOFORK  = "box-nofork"
+	DAEMON  = "box-daemon"
 )
@@ -0,0 +1,211 @@
+package mw
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/tddhit/tools/log"
+)
+
+// Config changes of the confcenter are pushed to the running workers over
+// the socketpair, and applied by the callback registered by OnConfigChange.
+// The master falls back to a fork-based reload if a top-level key set by
+// WithConfigRestartKeys changed, or if any worker fails to apply the config.
+// A config whose reload fails is rejected, the workers which applied it are
+// given the old config back, so the old workers keep running with the old
+// config.
+
+const confPushTimeout = 5 * time.Second
+
+var errNoConfHandler = errors.New("no config handler")
+
+var (
+	confMu      sync.RWMutex
+	confHandler func(raw []byte) error
+)
+
+// OnConfigChange registers f to apply the raw config pushed by the master.
+// It must be called in the worker before Go.
+func OnConfigChange(f func(raw []byte) error) {
+	confMu.Lock()
+	confHandler = f
+	confMu.Unlock()
+}
+
+func (m *master) watchConf() {
+	if m.confCenter == nil {
+		return
+	}
+	conf, err := m.confCenter.Fetch()
+	if err != nil {
+		log.Error(err)
+	}
+	watchC, err := m.confCenter.Watch()
+	if err != nil {
+		log.Error(err)
+	}
+	for range watchC {
+		conf = m.pushConf(conf)
+	}
+}
+
+// pushConf fetches the new config and hands it to the workers, it returns
+// the config in effect afterwards.
+func (m *master) pushConf(old []byte) []byte {
+	raw, err := m.confCenter.Fetch()
+	if err != nil {
+		return old
+	}
+	if bytes.Equal(raw, old) {
+		return old
+	}
+	return m.changeConf(old, raw)
+}
+
+func (m *master) changeConf(old, raw []byte) []byte {
+	if err := m.validateConf(raw); err != nil {
+		log.Errorf("ConfInvalid\tPid=%d\tErr=%s\n", m.pid, err.Error())
+		return old
+	}
+	if key, ok := m.confRestart(old, raw); ok {
+		log.Infof("ConfReload\tPid=%d\tKey=%s\n", m.pid, key)
+		return m.reloadConf(old, raw)
+	}
+	var (
+		applied []int
+		failed  bool
+	)
+	msg := message{Typ: msgConfig, Value: raw}
+	for _, r := range m.broadcast(msg, confPushTimeout) {
+		if r.Err != nil {
+			log.Warnf("ConfPushFail\tPid=%d\tErr=%s\n", r.Pid, r.Err.Error())
+			failed = true
+		} else {
+			applied = append(applied, r.Pid)
+		}
+	}
+	if !failed {
+		log.Infof("ConfPush\tPid=%d\n", m.pid)
+		return raw
+	}
+	conf := m.reloadConf(old, raw)
+	if !bytes.Equal(conf, raw) {
+		m.revertConf(old, applied)
+	}
+	return conf
+}
+
+// revertConf pushes old to the workers pids which applied a rejected config.
+func (m *master) revertConf(old []byte, pids []int) {
+	if len(old) == 0 {
+		// nothing was pushed before, the workers keep the rejected config.
+		log.Warnf("ConfRevertSkip\tPid=%d\tWorkers=%v\n", m.pid, pids)
+		return
+	}
+	msg := message{Typ: msgConfig, Value: old}
+	for _, r := range m.request(pids, msg, confPushTimeout) {
+		if r.Err != nil {
+			log.Errorf("ConfRevertFail\tPid=%d\tErr=%s\n", r.Pid, r.Err.Error())
+		} else {
+			log.Infof("ConfRevert\tPid=%d\n", r.Pid)
+		}
+	}
+}
+
+// reloadConf reloads the workers for raw and waits for the result.
+func (m *master) reloadConf(old, raw []byte) []byte {
+	done := make(chan bool, 1)
+	m.reload(done)
+	if !<-done {
+		log.Errorf("ConfRejected\tPid=%d\tErr=reload failed\n", m.pid)
+		return old
+	}
+	return raw
+}
+
+func (m *master) validateConf(raw []byte) error {
+	var v map[string]interface{}
+	if err := yaml.Unmarshal(raw, &v); err != nil {
+		return err
+	}
+	if m.confValidator != nil {
+		return m.confValidator(raw)
+	}
+	return nil
+}
+
+// confRestart returns the first restart key whose value differs.
+func (m *master) confRestart(old, raw []byte) (string, bool) {
+	var o, n map[string]interface{}
+	yaml.Unmarshal(old, &o)
+	yaml.Unmarshal(raw, &n)
+	for _, key := range m.confRestartKeys {
+		if !reflect.DeepEqual(o[key], n[key]) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func (w *worker) applyConf(req *message) {
+	rsp := &message{Typ: msgReply}
+	if err := w.apply(req.Value); err != nil {
+		rsp.Err = err.Error()
+	}
+	if err := w.conn.reply(req, rsp); err != nil {
+		log.Errorf("WriteMsg\tPid=%d\tErr=%s\n", w.pid, err.Error())
+	}
+}
+
+func (w *worker) apply(raw []byte) (err error) {
+	confMu.RLock()
+	f := confHandler
+	confMu.RUnlock()
+
+	if f == nil {
+		err = errNoConfHandler
+	} else {
+		err = f(raw)
+	}
+	if err != nil {
+		log.Errorf("ConfApply\tPid=%d\tErr=%s\n", w.pid, err.Error())
+	} else {
+		log.Infof("ConfApply\tPid=%d\n", w.pid)
+	}
+	return
+}
+
+// watchConf applies the config changes in single-process mode, where there
+// is no master to push them. Restart keys can't be honored there.
+func (w *worker) watchConf() {
+	if w.confCenter == nil {
+		return
+	}
+	conf, err := w.confCenter.Fetch()
+	if err != nil {
+		log.Error(err)
+	}
+	watchC, err := w.confCenter.Watch()
+	if err != nil {
+		log.Error(err)
+	}
+	for range watchC {
+		raw, err := w.confCenter.Fetch()
+		if err != nil || bytes.Equal(raw, conf) {
+			continue
+		}
+		if w.confValidator != nil {
+			if err := w.confValidator(raw); err != nil {
+				log.Errorf("ConfInvalid\tPid=%d\tErr=%s\n", w.pid, err.Error())
+				continue
+			}
+		}
+		conf = raw
+		w.apply(raw)
+	}
+}
@@ -0,0 +1,108 @@
+package mw
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWorker answers the configs pushed to it, it fails to apply reject.
+type fakeWorker struct {
+	mu      sync.Mutex
+	applied []string
+}
+
+func (w *fakeWorker) serve(c *msgConn, reject string) {
+	for {
+		msg, err := c.read("worker", 0)
+		if err != nil {
+			return
+		}
+		rsp := &message{Typ: msgReply}
+		if string(msg.Value) == reject {
+			rsp.Err = "invalid"
+		} else {
+			w.mu.Lock()
+			w.applied = append(w.applied, string(msg.Value))
+			w.mu.Unlock()
+		}
+		c.reply(msg, rsp)
+	}
+}
+
+func (w *fakeWorker) confs() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.applied...)
+}
+
+func TestChangeConfPartialFailure(t *testing.T) {
+	// the reload the master falls back to is rejected.
+	rejectReload := func(ctx context.Context, e Event) error {
+		return errors.New("no reload")
+	}
+	m := &master{hooks: &hooks{
+		timeout:      time.Second,
+		beforeReload: []Hook{rejectReload},
+	}}
+	workers := make([]*fakeWorker, 3)
+	for pid := 1; pid <= 3; pid++ {
+		mc, wc := msgPair(t)
+		go mc.read("master", pid)
+		w := &fakeWorker{}
+		reject := ""
+		if pid == 2 {
+			reject = "b: 2\n"
+		}
+		go w.serve(wc, reject)
+		workers[pid-1] = w
+		m.children.Store(pid, workerAlive)
+		m.conns.Store(pid, mc)
+	}
+
+	old, raw := []byte("a: 1\n"), []byte("b: 2\n")
+	if got := m.changeConf(old, raw); string(got) != string(old) {
+		t.Fatalf("changeConf = %q, want the old config", got)
+	}
+	want := [][]string{
+		{"b: 2\n", "a: 1\n"}, // applied, then reverted
+		nil,                  // failed, kept the old config
+		{"b: 2\n", "a: 1\n"},
+	}
+	for i, w := range workers {
+		got := w.confs()
+		if len(got) != len(want[i]) {
+			t.Fatalf("worker %d applied %q, want %q", i+1, got, want[i])
+		}
+		for j := range got {
+			if got[j] != want[i][j] {
+				t.Fatalf("worker %d applied %q, want %q", i+1, got, want[i])
+			}
+		}
+	}
+}
+
+func TestChangeConf(t *testing.T) {
+	m := &master{}
+	mc, wc := msgPair(t)
+	go mc.read("master", 1)
+	w := &fakeWorker{}
+	go w.serve(wc, "")
+	m.children.Store(1, workerAlive)
+	m.conns.Store(1, mc)
+	// a worker being replaced gets no config.
+	m.children.Store(2, workerReload)
+
+	old, raw := []byte("a: 1\n"), []byte("a: 2\n")
+	if got := m.changeConf(old, raw); string(got) != string(raw) {
+		t.Fatalf("changeConf = %q, want the new config", got)
+	}
+	if got := m.changeConf(raw, []byte("a: [")); string(got) != string(raw) {
+		t.Fatalf("changeConf of invalid yaml = %q", got)
+	}
+	if got := w.confs(); len(got) != 1 || got[0] != string(raw) {
+		t.Fatalf("applied %q", got)
+	}
+}
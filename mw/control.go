@@ -0,0 +1,140 @@
+package mw
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tddhit/tools/log"
+)
+
+// Control API of the master, used by `box-cli ctl`.
+//
+//	GET  /ctl/workers         list workers
+//	POST /ctl/reload          same as SIGHUP, 409 while busy or stopping
+//	POST /ctl/restart?pid=xx  replace a single worker gracefully
+//	POST /ctl/stop            same as SIGQUIT
+//	POST /ctl/reopen          reopen log files
+//	GET  /ctl/crashes?lines=n last lines of the latest crashed workers
+//
+// Requests must carry "Authorization: Bearer <token>" if a token is set by
+// WithControlToken, otherwise only loopback clients are allowed.
+
+type ctlRsp struct {
+	Code    int           `json:"code"`
+	Msg     string        `json:"msg,omitempty"`
+	Pid     int           `json:"pid,omitempty"`
+	Workers []workerStats `json:"workers,omitempty"`
+	Crashes []crashTail   `json:"crashes,omitempty"`
+}
+
+func (m *master) handleCtl() {
+	http.HandleFunc("/ctl/workers", m.ctl("GET", m.doCtlWorkers))
+	http.HandleFunc("/ctl/reload", m.ctl("POST", m.doCtlReload))
+	http.HandleFunc("/ctl/restart", m.ctl("POST", m.doCtlRestart))
+	http.HandleFunc("/ctl/stop", m.ctl("POST", m.doCtlStop))
+	http.HandleFunc("/ctl/reopen", m.ctl("POST", m.doCtlReopen))
+	http.HandleFunc("/ctl/crashes", m.ctl("GET", m.doCtlCrashes))
+}
+
+func (m *master) ctl(method string,
+	h func(*http.Request) *ctlRsp) http.HandlerFunc {
+
+	return ctlHandler(m.pid, m.ctlToken, method, h)
+}
+
+// ctlHandler serves a control request of the process pid, see also
+// serveMaster in single-process mode.
+func ctlHandler(pid int, token, method string,
+	h func(*http.Request) *ctlRsp) http.HandlerFunc {
+
+	return func(rsp http.ResponseWriter, req *http.Request) {
+		var r *ctlRsp
+		switch {
+		case !authorized(token, req):
+			r = &ctlRsp{Code: http.StatusUnauthorized, Msg: "unauthorized"}
+		case req.Method != method:
+			r = &ctlRsp{Code: http.StatusMethodNotAllowed,
+				Msg: "method not allowed"}
+		default:
+			r = h(req)
+			log.Infof("Control\tPid=%d\tPath=%s\tRemote=%s\tCode=%d\n",
+				pid, req.URL.Path, req.RemoteAddr, r.Code)
+		}
+		if r.Pid == 0 {
+			r.Pid = pid
+		}
+		out, _ := json.Marshal(r)
+		rsp.Header().Set("Content-Type", "application/json; charset=utf-8")
+		rsp.WriteHeader(r.Code)
+		rsp.Write(out)
+	}
+}
+
+func authorized(ctlToken string, req *http.Request) bool {
+	if ctlToken == "" {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsLoopback()
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(ctlToken)) == 1
+}
+
+func (m *master) doCtlWorkers(req *http.Request) *ctlRsp {
+	return &ctlRsp{Code: http.StatusOK, Workers: m.workerStats()}
+}
+
+func (m *master) doCtlReload(req *http.Request) *ctlRsp {
+	if atomic.LoadInt32(&m.closing) == 1 {
+		return &ctlRsp{Code: http.StatusConflict, Msg: "stopping"}
+	}
+	if !m.signal(syscall.SIGHUP) {
+		return &ctlRsp{Code: http.StatusConflict, Msg: "busy, try again"}
+	}
+	return &ctlRsp{Code: http.StatusOK, Msg: "reloading"}
+}
+
+func (m *master) doCtlRestart(req *http.Request) *ctlRsp {
+	pid, err := strconv.Atoi(req.FormValue("pid"))
+	if err != nil {
+		return &ctlRsp{Code: http.StatusBadRequest, Msg: "invalid pid"}
+	}
+	state, ok := m.children.Load(pid)
+	slot, _ := m.slots.Load(pid)
+	if !ok || state.(workerState) != workerAlive || slot == nil {
+		return &ctlRsp{Code: http.StatusNotFound, Msg: "no alive worker"}
+	}
+	// a reload of one slot, see reloadDone.
+	m.reloadBegin(1, nil)
+	go func() {
+		m.forkC <- forkReq{reasonReload, slot.(int)}
+	}()
+	return &ctlRsp{Code: http.StatusOK, Msg: "restarting " + strconv.Itoa(pid)}
+}
+
+func (m *master) doCtlStop(req *http.Request) *ctlRsp {
+	// let the response out before the master starts draining.
+	time.AfterFunc(100*time.Millisecond, m.stop)
+	return &ctlRsp{Code: http.StatusOK, Msg: "stopping"}
+}
+
+func (m *master) doCtlReopen(req *http.Request) *ctlRsp {
+	log.Reopen()
+	m.output.reopen()
+	return &ctlRsp{Code: http.StatusOK, Msg: "reopened"}
+}
+
+func (m *master) doCtlCrashes(req *http.Request) *ctlRsp {
+	n, _ := strconv.Atoi(req.FormValue("lines"))
+	return &ctlRsp{Code: http.StatusOK, Crashes: m.output.crashTails(n)}
+}
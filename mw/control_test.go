@@ -0,0 +1,66 @@
+package mw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCtlReloadBusy(t *testing.T) {
+	m := &master{signalC: make(chan os.Signal, 1), stopC: make(chan struct{})}
+	req := httptest.NewRequest("POST", "/ctl/reload", nil)
+	// nothing reads signalC, as while the master drains.
+	if rsp := m.doCtlReload(req); rsp.Code != http.StatusOK {
+		t.Fatalf("got %+v", rsp)
+	}
+	done := make(chan *ctlRsp)
+	go func() {
+		done <- m.doCtlReload(req)
+	}()
+	select {
+	case rsp := <-done:
+		if rsp.Code != http.StatusConflict {
+			t.Fatalf("got %+v, want 409", rsp)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reload blocked")
+	}
+	if sig := <-m.signalC; sig != syscall.SIGHUP {
+		t.Fatalf("got %s", sig)
+	}
+	atomic.StoreInt32(&m.closing, 1)
+	if rsp := m.doCtlReload(req); rsp.Code != http.StatusConflict {
+		t.Fatalf("got %+v, want 409 while stopping", rsp)
+	}
+	if len(m.signalC) != 0 {
+		t.Fatal("SIGHUP sent while stopping")
+	}
+}
+
+func TestStopNeverBlocks(t *testing.T) {
+	m := &master{signalC: make(chan os.Signal, 1), stopC: make(chan struct{})}
+	f := &MW{master: m}
+	done := make(chan struct{})
+	go func() {
+		// the master loop is gone, stopping twice is fine.
+		f.Stop()
+		f.Stop()
+		m.doCtlStop(httptest.NewRequest("POST", "/ctl/stop", nil))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked")
+	}
+	select {
+	case <-m.stopC:
+	default:
+		t.Fatal("stopC is open")
+	}
+	time.Sleep(200 * time.Millisecond) // the delayed stop of doCtlStop
+}
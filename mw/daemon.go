@@ -0,0 +1,56 @@
+package mw
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/tddhit/box/mw/common"
+)
+
+// daemonTimeout bounds how long the starting process waits for the detached
+// master to take the pid file.
+const daemonTimeout = 10 * time.Second
+
+// daemonize starts the master again in a new session with stdio on
+// /dev/null, and exits once the detached master holds the pid file, or with
+// status 1 if it doesn't.
+func daemonize(pidPath string) {
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "daemonize:", err)
+		os.Exit(1)
+	}
+	execSpec := &syscall.ProcAttr{
+		Env:   append(os.Environ(), common.DAEMON+"=1"),
+		Files: []uintptr{null.Fd(), null.Fd(), null.Fd()},
+		Sys:   &syscall.SysProcAttr{Setsid: true},
+	}
+	pid, err := syscall.ForkExec(os.Args[0], os.Args, execSpec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "daemonize:", err)
+		os.Exit(1)
+	}
+	for start := time.Now(); time.Since(start) < daemonTimeout; {
+		var status syscall.WaitStatus
+		if wpid, _ := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); wpid == pid {
+			fmt.Fprintf(os.Stderr, "daemon %d exited with status %d\n",
+				pid, status.ExitStatus())
+			os.Exit(1)
+		}
+		// the pid is written only after the lock is taken.
+		if runningPID(pidPath) == pid {
+			fmt.Printf("daemon %d started\n", pid)
+			os.Exit(0)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	fmt.Fprintf(os.Stderr, "daemon %d did not lock %s within %s\n",
+		pid, pidPath, daemonTimeout)
+	os.Exit(1)
+}
+
+func isDaemon() bool {
+	return os.Getenv(common.DAEMON) == "1"
+}
@@ -0,0 +1,124 @@
+package mw
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/tddhit/tools/log"
+)
+
+// Lifecycle hooks. Hooks of one kind run in the order they are added, each
+// one bounded by the hook timeout. An error or timeout changes the lifecycle:
+//
+//	OnMasterStart   master  before forking workers   master exits
+//	OnWorkerStart   worker  before serving           worker exits
+//	OnWorkerReady   worker  before taking over       worker exits
+//	OnBeforeReload  master  before forking on reload reload is aborted
+//	OnWorkerCrash   master  before restarting        slot is not restarted
+//	OnShutdown      both    after draining           only logged
+//
+// Hooks must be added before Go.
+
+const defaultHookTimeout = 10 * time.Second
+
+var errHookTimeout = errors.New("hook timeout")
+
+// Event describes why a hook is called.
+type Event struct {
+	// start, reload, crash, upgrade, hang or shutdown, a worker gets it
+	// from REASON.
+	Reason string
+	Pid    int
+	Slot   int    // -1 for the master
+	Exit   string // exit status of a crashed worker
+}
+
+// Hook is a lifecycle hook, ctx is done once the hook timeout is over.
+type Hook func(ctx context.Context, e Event) error
+
+type hooks struct {
+	timeout      time.Duration
+	masterStart  []Hook
+	workerStart  []Hook
+	workerReady  []Hook
+	beforeReload []Hook
+	workerCrash  []Hook
+	shutdown     []Hook
+}
+
+// run calls hs one by one and stops at the first error.
+func (h *hooks) run(name string, hs []Hook, e Event) error {
+	for _, hook := range hs {
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		errC := make(chan error, 1)
+		go func(hook Hook) {
+			errC <- hook(ctx, e)
+		}(hook)
+		var err error
+		select {
+		case err = <-errC:
+		case <-ctx.Done():
+			err = errHookTimeout
+		}
+		cancel()
+		if err != nil {
+			log.Errorf("Hook\tName=%s\tPid=%d\tReason=%s\tErr=%s\n",
+				name, e.Pid, e.Reason, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// OnMasterStart adds a hook run by the master before it forks the workers,
+// an error makes the master exit.
+func (f *MW) OnMasterStart(h Hook) {
+	f.hooks.masterStart = append(f.hooks.masterStart, h)
+}
+
+// OnWorkerStart adds a hook run by a worker before it starts serving, an
+// error makes the worker exit.
+func (f *MW) OnWorkerStart(h Hook) {
+	f.hooks.workerStart = append(f.hooks.workerStart, h)
+}
+
+// OnWorkerReady adds a hook run by a worker once it is ready, before it
+// takes over, an error makes the worker exit.
+func (f *MW) OnWorkerReady(h Hook) {
+	f.hooks.workerReady = append(f.hooks.workerReady, h)
+}
+
+// OnBeforeReload adds a hook run by the master before it forks the workers
+// of a reload, an error aborts the reload.
+func (f *MW) OnBeforeReload(h Hook) {
+	f.hooks.beforeReload = append(f.hooks.beforeReload, h)
+}
+
+// OnWorkerCrash adds a hook run by the master before it restarts a crashed
+// worker, an error leaves the slot down.
+func (f *MW) OnWorkerCrash(h Hook) {
+	f.hooks.workerCrash = append(f.hooks.workerCrash, h)
+}
+
+// OnShutdown adds a hook run by the master and the workers after draining,
+// an error is only logged.
+func (f *MW) OnShutdown(h Hook) {
+	f.hooks.shutdown = append(f.hooks.shutdown, h)
+}
+
+func (m *master) event(reason string) Event {
+	return Event{Reason: reason, Pid: m.pid, Slot: -1}
+}
+
+func (w *worker) event(reason string) Event {
+	return Event{Reason: reason, Pid: w.pid, Slot: w.slot}
+}
+
+func workerReason() string {
+	if reason := os.Getenv("REASON"); reason != "" {
+		return reason
+	}
+	return reasonStart
+}
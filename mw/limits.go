@@ -0,0 +1,101 @@
+package mw
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/tddhit/tools/log"
+)
+
+// Limits are applied to every worker. Rlimits, CPU pinning and the privilege
+// drop are done by the worker right after startup, after it has inherited
+// the listeners bound by the master. Cgroups are set up by the master, which
+// forks every worker into its own, and skipped if cgroup v2 is unavailable.
+type Limits struct {
+	// e.g. syscall.RLIMIT_NOFILE, syscall.RLIMIT_CORE, syscall.RLIMIT_AS
+	Rlimits map[int]syscall.Rlimit
+
+	// cgroup v2, each worker gets its own cgroup under <Cgroup> in the
+	// cgroup of the master, Cgroup defaults to the program name.
+	Cgroup string
+	Memory int64   // memory.max in bytes, 0 means no limit
+	CPU    float64 // cpu.max in CPUs, e.g. 1.5, 0 means no limit
+
+	// pin the worker of slot n to the n-th allowed CPU if the master runs
+	// more than one worker when it is forked.
+	PinCPU bool
+
+	// user and group the workers run as, the master keeps its own.
+	User  string
+	Group string
+}
+
+func (l *Limits) useCgroup() bool {
+	return l.Memory > 0 || l.CPU > 0
+}
+
+// applyLimits is called by the worker of slot.
+func applyLimits(l *Limits, slot, workerNum int) {
+	pid := os.Getpid()
+	for res, rlim := range l.Rlimits {
+		rlim := rlim
+		if err := syscall.Setrlimit(res, &rlim); err != nil {
+			log.Errorf("Setrlimit\tPid=%d\tResource=%d\tErr=%s\n",
+				pid, res, err.Error())
+		}
+	}
+	if l.PinCPU && workerNum > 1 {
+		if cpu, err := pinCPU(slot); err != nil {
+			log.Errorf("PinCPU\tPid=%d\tSlot=%d\tErr=%s\n", pid, slot, err.Error())
+		} else {
+			log.Infof("PinCPU\tPid=%d\tSlot=%d\tCPU=%d\n", pid, slot, cpu)
+		}
+	}
+	if l.User != "" || l.Group != "" {
+		if err := dropPrivileges(l.User, l.Group); err != nil {
+			log.Fatalf("DropPrivileges\tPid=%d\tErr=%s\n", pid, err.Error())
+		}
+		log.Infof("DropPrivileges\tPid=%d\tUid=%d\tGid=%d\n",
+			pid, os.Getuid(), os.Getgid())
+	}
+}
+
+func dropPrivileges(userName, groupName string) error {
+	uid, gid := -1, -1
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			if u, err = user.LookupId(userName); err != nil {
+				return err
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return err
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	// group first, setgid is not allowed any more once uid is dropped.
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return err
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return err
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
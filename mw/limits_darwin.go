@@ -0,0 +1,29 @@
+package mw
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/tddhit/tools/log"
+)
+
+func pinCPU(slot int) (int, error) {
+	return -1, errors.New("cpu affinity is not supported")
+}
+
+type cgroup struct{}
+
+func newCgroup(l *Limits) *cgroup {
+	if l != nil && l.useCgroup() {
+		log.Warn("CgroupUnavailable\tErr=cgroup is not supported\n")
+	}
+	return nil
+}
+
+func (c *cgroup) forkExec(argv0 string, argv []string,
+	attr *syscall.ProcAttr) (int, error) {
+
+	return syscall.ForkExec(argv0, argv, attr)
+}
+
+func (c *cgroup) remove(pid int) {}
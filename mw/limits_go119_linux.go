@@ -0,0 +1,19 @@
+//go:build !go1.20
+// +build !go1.20
+
+package mw
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errCgroupFD = errors.New("CLONE_INTO_CGROUP needs go1.20")
+
+// forkIntoCgroup before Go 1.20 always fails, forkExec then moves the worker
+// into its cgroup right after fork.
+func forkIntoCgroup(argv0 string, argv []string, attr *syscall.ProcAttr,
+	dir string) (int, error) {
+
+	return 0, errCgroupFD
+}
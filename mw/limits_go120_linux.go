@@ -0,0 +1,26 @@
+//go:build go1.20
+// +build go1.20
+
+package mw
+
+import "syscall"
+
+// forkIntoCgroup needs SysProcAttr.UseCgroupFD, which is new in Go 1.20.
+func forkIntoCgroup(argv0 string, argv []string, attr *syscall.ProcAttr,
+	dir string) (int, error) {
+
+	fd, err := syscall.Open(dir,
+		syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.Close(fd)
+	a := *attr
+	sys := syscall.SysProcAttr{}
+	if attr.Sys != nil {
+		sys = *attr.Sys
+	}
+	sys.UseCgroupFD, sys.CgroupFD = true, fd
+	a.Sys = &sys
+	return syscall.ForkExec(argv0, argv, &a)
+}
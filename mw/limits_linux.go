@@ -0,0 +1,235 @@
+package mw
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/tddhit/tools/log"
+)
+
+const (
+	cgroupRoot = "/sys/fs/cgroup"
+	cpuPeriod  = 100000 // us
+)
+
+type cpuMask [16]uint64 // 1024 CPUs
+
+// pinCPU pins every thread of the worker to one of the allowed CPUs, picked
+// by slot, and returns it.
+func pinCPU(slot int) (int, error) {
+	var allowed cpuMask
+	_, _, e := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, 0,
+		unsafe.Sizeof(allowed), uintptr(unsafe.Pointer(&allowed)))
+	if e != 0 {
+		return -1, e
+	}
+	var cpus []int
+	for i := 0; i < len(allowed)*64; i++ {
+		if allowed[i/64]&(1<<uint(i%64)) != 0 {
+			cpus = append(cpus, i)
+		}
+	}
+	if len(cpus) == 0 {
+		return -1, errors.New("no allowed cpu")
+	}
+	cpu := cpus[slot%len(cpus)]
+	var mask cpuMask
+	mask[cpu/64] = 1 << uint(cpu%64)
+	// affinity is per thread, threads started later inherit it.
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return -1, err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		_, _, e := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY,
+			uintptr(tid), unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+		if e != 0 && e != syscall.ESRCH {
+			return -1, e
+		}
+	}
+	return cpu, nil
+}
+
+// cgroup puts each worker into a cgroup v2 of its own under dir, which is
+// a child of the cgroup of the master, so the workers stay accounted to the
+// service. cgroup v2 allows no process in a cgroup whose controllers are
+// delegated to children, so the master moves itself into the leaf
+// cgroupMasterLeaf if it shares its cgroup with the workers' one.
+type cgroup struct {
+	dir    string
+	memory int64
+	cpu    float64
+	seq    int64
+	dirs   sync.Map // key: pid, value: dir of the worker
+}
+
+const cgroupMasterLeaf = "box-master"
+
+// newCgroup returns nil if no cgroup limit is set or cgroup v2 is
+// unavailable.
+func newCgroup(l *Limits) *cgroup {
+	if l == nil || !l.useCgroup() {
+		return nil
+	}
+	own, err := ownCgroup()
+	if err != nil {
+		log.Warnf("CgroupUnavailable\tErr=%s\n", err.Error())
+		return nil
+	}
+	_, err = os.Stat(filepath.Join(own, "cgroup.controllers"))
+	if err != nil {
+		log.Warnf("CgroupUnavailable\tErr=%s\n", err.Error())
+		return nil
+	}
+	// an upgraded master starts in the leaf of the old one.
+	if filepath.Base(own) == cgroupMasterLeaf {
+		own = filepath.Dir(own)
+	}
+	name := l.Cgroup
+	if name == "" {
+		name = filepath.Base(os.Args[0])
+	}
+	c := &cgroup{
+		dir:    filepath.Join(own, name),
+		memory: l.Memory,
+		cpu:    l.CPU,
+	}
+	var controllers []string
+	if c.memory > 0 {
+		controllers = append(controllers, "+memory")
+	}
+	if c.cpu > 0 {
+		controllers = append(controllers, "+cpu")
+	}
+	subtree := []byte(strings.Join(controllers, " "))
+	err = enableControllers(own, subtree)
+	if err == syscall.EBUSY {
+		if err = moveSelf(filepath.Join(own, cgroupMasterLeaf)); err == nil {
+			err = enableControllers(own, subtree)
+		}
+	}
+	if err == nil {
+		if err = os.MkdirAll(c.dir, 0755); err == nil {
+			err = enableControllers(c.dir, subtree)
+		}
+	}
+	if err != nil {
+		log.Warnf("CgroupUnavailable\tDir=%s\tErr=%s\n", c.dir, err.Error())
+		return nil
+	}
+	log.Infof("Cgroup\tPid=%d\tDir=%s\n", os.Getpid(), c.dir)
+	return c
+}
+
+// ownCgroup returns the cgroup v2 dir of the process.
+func ownCgroup() (string, error) {
+	b, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return filepath.Join(cgroupRoot, line[len("0::"):]), nil
+		}
+	}
+	return "", errors.New("no cgroup v2 hierarchy")
+}
+
+func enableControllers(dir string, subtree []byte) error {
+	err := ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"),
+		subtree, 0644)
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
+
+func moveSelf(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	log.Infof("CgroupMove\tPid=%d\tDir=%s\n", os.Getpid(), dir)
+	return ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"),
+		[]byte(strconv.Itoa(os.Getpid())), 0644)
+}
+
+// create makes the cgroup of a new worker with the limits set.
+func (c *cgroup) create() (string, error) {
+	dir := filepath.Join(c.dir, fmt.Sprintf("worker-%d-%d", os.Getpid(),
+		atomic.AddInt64(&c.seq, 1)))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", err
+	}
+	if c.memory > 0 {
+		err := ioutil.WriteFile(filepath.Join(dir, "memory.max"),
+			[]byte(strconv.FormatInt(c.memory, 10)), 0644)
+		if err != nil {
+			os.Remove(dir)
+			return "", err
+		}
+	}
+	if c.cpu > 0 {
+		quota := fmt.Sprintf("%d %d", int64(c.cpu*cpuPeriod), cpuPeriod)
+		err := ioutil.WriteFile(filepath.Join(dir, "cpu.max"),
+			[]byte(quota), 0644)
+		if err != nil {
+			os.Remove(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// forkExec starts a worker in a new cgroup. The worker is placed there at
+// fork with CLONE_INTO_CGROUP, so it never runs unlimited. Kernels before
+// 5.7 and builds before Go 1.20 lack it, the worker is then moved right
+// after fork.
+func (c *cgroup) forkExec(argv0 string, argv []string,
+	attr *syscall.ProcAttr) (int, error) {
+
+	if c == nil {
+		return syscall.ForkExec(argv0, argv, attr)
+	}
+	dir, err := c.create()
+	if err != nil {
+		log.Warnf("Cgroup\tErr=%s\n", err.Error())
+		return syscall.ForkExec(argv0, argv, attr)
+	}
+	pid, err := forkIntoCgroup(argv0, argv, attr, dir)
+	if err != nil {
+		log.Warnf("CgroupFork\tDir=%s\tErr=%s\n", dir, err.Error())
+		if pid, err = syscall.ForkExec(argv0, argv, attr); err != nil {
+			os.Remove(dir)
+			return pid, err
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"),
+			[]byte(strconv.Itoa(pid)), 0644)
+		if err != nil {
+			log.Warnf("Cgroup\tPid=%d\tErr=%s\n", pid, err.Error())
+			os.Remove(dir)
+			return pid, nil
+		}
+	}
+	c.dirs.Store(pid, dir)
+	return pid, nil
+}
+
+func (c *cgroup) remove(pid int) {
+	if dir, ok := c.dirs.Load(pid); ok {
+		c.dirs.Delete(pid)
+		os.Remove(dir.(string))
+	}
+}
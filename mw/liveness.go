@@ -0,0 +1,203 @@
+package mw
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tddhit/tools/log"
+)
+
+// LivenessPolicy controls the master-side watchdog. The master pings every
+// alive worker each Interval over the unix socket, and the worker answers
+// once its admin server served a probe request, see pong. A worker that
+// misses MaxMisses pings in a row is killed with SIGKILL and replaced, with
+// reason "hang". Workers are not judged during StartPeriod after fork.
+type LivenessPolicy struct {
+	Interval    time.Duration
+	MaxMisses   int // 0 only measures latency, never kills
+	StartPeriod time.Duration
+}
+
+var defaultLivenessPolicy = LivenessPolicy{
+	Interval:    time.Second,
+	StartPeriod: 30 * time.Second,
+}
+
+func (p *LivenessPolicy) fill() {
+	if p.Interval <= 0 {
+		p.Interval = defaultLivenessPolicy.Interval
+	}
+	if p.StartPeriod <= 0 {
+		p.StartPeriod = defaultLivenessPolicy.StartPeriod
+	}
+}
+
+// liveness is the heartbeat state of a worker.
+type liveness struct {
+	sync.Mutex
+	started time.Time
+	pending int64 // UnixNano of the unanswered ping, 0 if none
+	misses  int
+	latency time.Duration
+}
+
+func (l *liveness) pong(sent int64) {
+	l.Lock()
+	defer l.Unlock()
+
+	if sent != l.pending {
+		return
+	}
+	l.latency = time.Since(time.Unix(0, sent))
+	l.pending = 0
+	l.misses = 0
+}
+
+// ping records a new ping and returns the number of missed ones so far.
+func (l *liveness) ping(now time.Time) (misses int, sent int64) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.pending != 0 {
+		l.misses++
+	}
+	l.pending = now.UnixNano()
+	return l.misses, l.pending
+}
+
+func (l *liveness) fill(ws *workerStats) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.latency > 0 {
+		ws.Latency = l.latency.String()
+	}
+	ws.Misses = l.misses
+}
+
+func (m *master) livenessOf(pid int) *liveness {
+	l, _ := m.liveness.LoadOrStore(pid, &liveness{started: time.Now()})
+	return l.(*liveness)
+}
+
+func (m *master) watchLiveness() {
+	tick := time.Tick(m.livenessPolicy.Interval)
+	for now := range tick {
+		if atomic.LoadInt32(&m.closing) != 0 {
+			return
+		}
+		m.children.Range(func(key, value interface{}) bool {
+			pid := key.(int)
+			if value.(workerState) != workerAlive {
+				return true
+			}
+			m.checkLiveness(pid, now)
+			return true
+		})
+	}
+}
+
+func (m *master) checkLiveness(pid int, now time.Time) {
+	l := m.livenessOf(pid)
+	misses, sent := l.ping(now)
+	p := m.livenessPolicy
+	if p.MaxMisses > 0 && misses >= p.MaxMisses &&
+		now.Sub(l.started) > p.StartPeriod {
+
+		log.Errorf("WorkerHang\tPid=%d\tMisses=%d\n", pid, misses)
+		m.hung.Store(pid, true)
+		syscall.Kill(pid, syscall.SIGKILL)
+		return
+	}
+	conn, ok := m.conns.Load(pid)
+	if !ok {
+		return
+	}
+	go func() {
+		msg := &message{Typ: msgPing}
+		if _, err := conn.(*msgConn).request(msg, p.Interval); err == nil {
+			l.pong(sent)
+		}
+	}()
+}
+
+// The worker answers a ping once its admin server served a request on
+// probeListener, which is private to the worker, unlike the admin addr shared
+// by all of them. The pong so shows that the worker still accepts and serves
+// http, not only that its socket reader runs.
+
+const probeTimeout = 10 * time.Second
+
+var errProbeClosed = errors.New("probe listener closed")
+
+// probeListener is an in-memory listener whose conns are made by dial.
+type probeListener struct {
+	connC  chan net.Conn
+	closeC chan struct{}
+	once   sync.Once
+}
+
+func newProbeListener() *probeListener {
+	return &probeListener{
+		connC:  make(chan net.Conn),
+		closeC: make(chan struct{}),
+	}
+}
+
+func (l *probeListener) dial() (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	select {
+	case l.connC <- c1:
+		return c2, nil
+	case <-l.closeC:
+		return nil, errProbeClosed
+	}
+}
+
+func (l *probeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connC:
+		return conn, nil
+	case <-l.closeC:
+		return nil, errProbeClosed
+	}
+}
+
+func (l *probeListener) Close() error {
+	l.once.Do(func() {
+		close(l.closeC)
+	})
+	return nil
+}
+
+func (l *probeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "probe", Net: "pipe"}
+}
+
+// pong replies to the ping of the master once the admin server of the
+// worker answered /status, whether ready or not.
+func (w *worker) pong(ping *message) {
+	c := &http.Client{
+		Timeout: probeTimeout,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			Dial: func(network, addr string) (net.Conn, error) {
+				return w.probe.dial()
+			},
+		},
+	}
+	rsp, err := c.Get("http://probe/status")
+	if err != nil {
+		log.Warnf("Probe\tPid=%d\tErr=%s\n", w.pid, err.Error())
+		return
+	}
+	rsp.Body.Close()
+	if err := w.conn.reply(ping, &message{Typ: msgPong}); err != nil {
+		log.Errorf("WriteMsg\tPid=%d\tErr=%s\n", w.pid, err.Error())
+	}
+}
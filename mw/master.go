@@ -1,22 +1,25 @@
 package mw
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/tddhit/box/confcenter"
 	"github.com/tddhit/box/mw/common"
+	"github.com/tddhit/box/socket"
 	"github.com/tddhit/tools/log"
 )
 
@@ -45,101 +48,242 @@ func (s workerState) String() string {
 }
 
 const (
-	reasonStart  = "start"
-	reasonReload = "reload"
-	reasonCrash  = "crash"
+	reasonStart   = "start"
+	reasonReload  = "reload"
+	reasonCrash   = "crash"
+	reasonUpgrade = "upgrade"
+	reasonHang    = "hang"
+	reasonScale   = "scale"
 
-	workerNum = 1
+	reasonShutdown = "shutdown"
 )
 
+type forkReq struct {
+	reason string
+	slot   int
+}
+
 type master struct {
-	addr      string
-	pid       int
-	pidPath   string
-	uc        sync.Map // key: workerPID, value:UnixConn
-	children  sync.Map // key: workerPID, value:state
-	forkStats sync.Map
-	forkWG    sync.WaitGroup
-	forkC     chan string
+	addr       string
+	workerAddr string
+	pid        int
+	pidPath    string
+	pidFile    *os.File // locked as long as the master runs
+	workerNum  int32    // see scale.go
+	conns      sync.Map // key: workerPID, value:*msgConn
+	children   sync.Map // key: workerPID, value:state
+	slots      sync.Map // key: workerPID, value:slot
+	current    sync.Map // key: slot, value:workerPID
+	slotStates sync.Map // key: slot, value:*slotState
+	forkStats  sync.Map
+	forkWG     sync.WaitGroup
+	started    sync.Map // key: workerPID, value:fork time
+	forkC      chan forkReq
+	signalC    chan os.Signal
+	stopC      chan struct{} // closed by stop
+	stopOnce   sync.Once
+	closing    int32
+
+	shutdownTimeout time.Duration
+	restartPolicy   RestartPolicy
+	livenessPolicy  LivenessPolicy
+	liveness        sync.Map // key: workerPID, value:*liveness
+	hung            sync.Map // key: workerPID, value:true if killed by watchdog
+	recyclePolicy   RecyclePolicy
+	scalePolicy     ScalePolicy
+	usages          sync.Map // key: workerPID, value:usage
+	recycles        recycles
+
+	readinessTimeout time.Duration
+	pendingReady     sync.Map // key: workerPID, value:slot, see readiness.go
+	cgroup           *cgroup
+	hooks            *hooks
+	output           *output
+	generation       int32 // bumped on every reload
+
+	// staged reload, see probation.go
+	probation   time.Duration
+	probations  sync.Map // key: workerPID, value:slot
+	probationMu sync.Mutex
+	reloads     reloads
+
+	// systemd, see systemd.go
+	readySlots sync.Map // key: slot, value:workerPID
+	notified   int32
+
+	// binary upgrade, see upgrade.go
+	upgradeTimeout time.Duration
+	upgrading      int32
+	upgradeC       chan struct{}
+	parent         *msgConn // old master, only during upgrade
+	takeovers      int32
 
-	confCenter *confcenter.ConfCenter
+	ctlToken        string
+	confCenter      *confcenter.ConfCenter
+	confValidator   func(raw []byte) error
+	confRestartKeys []string
 }
 
 func newMaster(ctx context.Context) *master {
 	f := ctx.Value(mwKey{}).(*MW)
-	return &master{
-		addr:    f.masterAddr,
-		pid:     os.Getpid(),
-		pidPath: f.pidPath,
-		forkC:   make(chan string),
+	m := &master{
+		addr:       f.masterAddr,
+		workerAddr: f.workerAddr,
+		pid:        os.Getpid(),
+		pidPath:    f.pidPath,
+		workerNum:  int32(f.workerNum),
 
-		confCenter: f.confCenter,
+		shutdownTimeout: f.shutdownTimeout,
+		restartPolicy:   *f.restartPolicy,
+		livenessPolicy:  *f.livenessPolicy,
+		recyclePolicy:   *f.recyclePolicy,
+		scalePolicy:     *f.scalePolicy,
+
+		readinessTimeout: f.readinessTimeout,
+		cgroup:           newCgroup(f.limits),
+		hooks:            f.hooks,
+		output:           newOutput(*f.outputPolicy),
+		generation:       1,
+		probation:        *f.probation,
+		forkC:            make(chan forkReq),
+		signalC:          make(chan os.Signal, 1),
+		stopC:            make(chan struct{}),
+
+		upgradeTimeout: f.upgradeTimeout,
+		upgradeC:       make(chan struct{}),
+
+		ctlToken:        f.ctlToken,
+		confCenter:      f.confCenter,
+		confValidator:   f.confValidator,
+		confRestartKeys: f.confRestartKeys,
+	}
+	if os.Getenv(common.UPGRADE) == "1" {
+		m.parent = inheritParent()
 	}
+	return m
 }
 
 func (m *master) run() {
 	m.savePID()
-	if err := os.Setenv(common.FORK, "1"); err != nil {
+	// the worker's admin listener is owned by master as well,
+	// see socket.SendListeners.
+	if m.workerAddr != "" {
+		if _, err := socket.Listen(m.workerAddr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	lis, err := socket.Listen(m.addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	reason := reasonStart
+	if m.parent != nil {
+		reason = reasonUpgrade
+	}
+	err = m.hooks.run("OnMasterStart", m.hooks.masterStart, m.event(reason))
+	if err != nil {
+		m.removePID()
 		log.Fatal(err)
 	}
 	go m.handleFork()
-	for i := 0; i < workerNum; i++ {
-		m.forkC <- reasonStart
+	for i := 0; i < m.numWorkers(); i++ {
+		m.forkC <- forkReq{reason, i}
 	}
 	go m.watchConf()
 	go m.watchWorker()
-	go m.serve()
+	go m.watchLiveness()
+	go m.watchRecycle()
+	go m.watchScale()
+	go m.serve(lis)
+	go watchdog(watchdogInterval(m.parent != nil), &m.closing)
 
-	log.Infof("MasterStart\tPid=%d", m.pid)
-	signalC := make(chan os.Signal)
-	signal.Notify(signalC)
+	log.Infof("MasterStart\tPid=%d\tWorkerNum=%d", m.pid, m.numWorkers())
+	signal.Notify(m.signalC)
 	for {
 		select {
-		case sig := <-signalC:
+		case sig := <-m.signalC:
 			log.Infof("WatchSignal\tPid=%d\tSig=%s\n", m.pid, sig)
 			switch sig {
 			case syscall.SIGHUP:
 				log.Reopen()
-				m.reload()
+				m.output.reopen()
+				m.reload(nil)
+			case syscall.SIGUSR2:
+				go m.upgrade()
 			case syscall.SIGINT, syscall.SIGQUIT:
+				sdNotify(sdStopping)
 				m.graceful()
-				fallthrough
+				goto exit
 			case syscall.SIGTERM:
+				sdNotify(sdStopping)
 				goto exit
 			}
+		case <-m.stopC:
+			sdNotify(sdStopping)
+			m.graceful()
+			goto exit
+		case <-m.upgradeC:
+			// the new master is up, drain and leave.
+			m.graceful()
+			goto exit
 		}
 	}
 exit:
 	m.close()
 }
 
+// signal hands sig to the master loop as if it was received, it returns
+// false if the loop is busy with another signal or has exited.
+func (m *master) signal(sig os.Signal) bool {
+	select {
+	case m.signalC <- sig:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop shuts down gracefully as SIGQUIT does. It never blocks, and does
+// nothing once the master is stopping.
+func (m *master) stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopC)
+	})
+}
+
 func (m *master) savePID() {
-	f, err := os.OpenFile(m.pidPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
+	f, err := lockPID(m.pidPath, m.pid)
 	if err != nil {
 		log.Fatal(err)
 	}
-	f.WriteString(strconv.Itoa(m.pid))
-	f.Sync()
-	f.Close()
+	m.pidFile = f
+	m.saveAddr()
 }
 
-func (m *master) removePID() {
-	err := os.Remove(m.pidPath)
+// saveAddr writes the master addr next to the pid file, so that box-cli ctl
+// can find the control API from the pid file.
+func (m *master) saveAddr() {
+	err := ioutil.WriteFile(m.addrPath(), []byte(m.addr), 0666)
 	if err != nil {
 		log.Error(err)
 	}
 }
 
-func (m *master) watchConf() {
-	if m.confCenter == nil {
-		return
-	}
-	watchC, err := m.confCenter.Watch()
+func (m *master) addrPath() string {
+	return strings.TrimSuffix(m.pidPath, ".oldbin") + ".addr"
+}
+
+func (m *master) removePID() {
+	// remove before unlocking, or a new master could lock the file which
+	// is about to be removed.
+	err := os.Remove(m.pidPath)
 	if err != nil {
 		log.Error(err)
 	}
-	for range watchC {
-		m.reload()
+	m.pidFile.Close()
+	// after upgrade the addr file belongs to the new master.
+	if !strings.HasSuffix(m.pidPath, ".oldbin") {
+		os.Remove(m.addrPath())
 	}
 }
 
@@ -149,11 +293,27 @@ func (m *master) watchWorker() {
 		state := value.(workerState)
 		switch state {
 		case workerCrash:
-			m.forkC <- reasonCrash
+			// only the newest worker of a slot is replaced, the old one
+			// is going away anyway during reload.
+			// slots removed by scaling down have no current worker.
+			slot, _ := m.slots.Load(pid)
+			cur, _ := m.current.Load(slot)
+			if cur == pid && atomic.LoadInt32(&m.closing) == 0 {
+				reason := reasonCrash
+				if _, ok := m.hung.Load(pid); ok {
+					reason = reasonHang
+				}
+				go m.crashed(pid, slot.(int), reason)
+			}
 			fallthrough
 		case workerQuit:
 			m.children.Delete(pid)
-			m.uc.Delete(pid)
+			m.conns.Delete(pid)
+			m.slots.Delete(pid)
+			m.liveness.Delete(pid)
+			m.hung.Delete(pid)
+			m.usages.Delete(pid)
+			m.started.Delete(pid)
 		}
 		return true
 	}
@@ -163,11 +323,67 @@ func (m *master) watchWorker() {
 	}
 }
 
-func (m *master) modifyState(from, to workerState) {
+func (m *master) slotState(slot int) *slotState {
+	s, _ := m.slotStates.LoadOrStore(slot, &slotState{})
+	return s.(*slotState)
+}
+
+// crashed runs the OnWorkerCrash hooks, which may keep the slot from
+// restarting.
+func (m *master) crashed(pid, slot int, reason string) {
+	s := m.slotState(slot)
+	var ws workerStats
+	s.fill(&ws)
+	e := Event{Reason: reason, Pid: pid, Slot: slot, Exit: ws.LastExit}
+	if err := m.hooks.run("OnWorkerCrash", m.hooks.workerCrash, e); err != nil {
+		s.stop()
+		m.giveUp(slot)
+		return
+	}
+	m.restart(slot, reason)
+}
+
+// restart forks a new worker for slot after the backoff of the restart
+// policy, or gives the slot up.
+func (m *master) restart(slot int, reason string) {
+	s := m.slotState(slot)
+	delay, giveUp := s.crash(&m.restartPolicy)
+	if giveUp {
+		m.giveUp(slot)
+		return
+	}
+	log.Warnf("WorkerRestart\tSlot=%d\tReason=%s\tBackoff=%s\n",
+		slot, reason, delay)
+	gen := s.generation()
+	time.AfterFunc(delay, func() {
+		if atomic.LoadInt32(&m.closing) != 0 {
+			return
+		}
+		// the slot was scaled down, and maybe up again, while backing off.
+		if slot >= m.numWorkers() || s.generation() != gen {
+			log.Infof("WorkerRestartCancel\tSlot=%d\tReason=%s\n", slot, reason)
+			return
+		}
+		m.forkC <- forkReq{reason, slot}
+	})
+}
+
+// giveUp reports the slot, which is not restarted any more, to OnGiveUp.
+func (m *master) giveUp(slot int) {
+	var ws workerStats
+	m.slotState(slot).fill(&ws)
+	log.Errorf("WorkerGiveUp\tSlot=%d\tRestarts=%d\tLastExit=%s\n",
+		slot, ws.Restarts, ws.LastExit)
+	if m.restartPolicy.OnGiveUp != nil {
+		go m.restartPolicy.OnGiveUp(slot, ws.Restarts, ws.LastExit)
+	}
+}
+
+func (m *master) modifyState(slot int, from, to workerState) {
 	f := func(key, value interface{}) bool {
 		pid := key.(int)
 		state := value.(workerState)
-		if state == from {
+		if s, ok := m.slots.Load(pid); ok && s.(int) == slot && state == from {
 			m.children.Store(pid, to)
 		}
 		return true
@@ -176,27 +392,33 @@ func (m *master) modifyState(from, to workerState) {
 }
 
 func (m *master) handleFork() {
-	for reason := range m.forkC {
-		switch reason {
-		case reasonStart:
+	for req := range m.forkC {
+		switch req.reason {
+		case reasonStart, reasonUpgrade:
 		case reasonReload:
-			m.modifyState(workerAlive, workerReload)
+			m.modifyState(req.slot, workerAlive, workerReload)
+			m.slotState(req.slot).reset()
 		case reasonCrash:
 		default:
 		}
-		if _, err := m.fork(reason); err != nil {
-			switch reason {
-			case reasonStart:
-				log.Fatal(reason, err)
+		if _, err := m.fork(req.reason, req.slot); err != nil {
+			switch req.reason {
+			case reasonStart, reasonUpgrade:
+				log.Fatal(req.reason, err)
 			default:
-				log.Error(reason, err)
+				log.Error(req.reason, err)
+			}
+			if req.reason == reasonReload {
+				m.reloadDone(false)
 			}
 		}
-		time.Sleep(time.Second)
+		if req.reason == reasonReload {
+			time.Sleep(time.Second)
+		}
 	}
 }
 
-func (m *master) fork(reason string) (pid int, err error) {
+func (m *master) fork(reason string, slot int) (pid int, err error) {
 	times, loaded := m.forkStats.LoadOrStore(reason, 1)
 	if loaded {
 		m.forkStats.Store(reason, times.(int)+1)
@@ -206,21 +428,48 @@ func (m *master) fork(reason string) (pid int, err error) {
 		log.Error(err)
 		return
 	}
+	syscall.CloseOnExec(fds[0])
+	// stdout and stderr of the worker, see output.go
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Error(err)
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return
+	}
 	execSpec := &syscall.ProcAttr{
-		Env: append(os.Environ(), "REASON="+reason, "PPID="+strconv.Itoa(m.pid)),
-		Files: []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd(),
-			uintptr(fds[1])},
+		Env: append(os.Environ(), common.FORK+"=1", "REASON="+reason,
+			"PPID="+strconv.Itoa(m.pid), "SLOT="+strconv.Itoa(slot),
+			"WORKERNUM="+strconv.Itoa(m.numWorkers())),
+		Files: []uintptr{os.Stdin.Fd(), w.Fd(), w.Fd(), uintptr(fds[1])},
 	}
-	pid, err = syscall.ForkExec(os.Args[0], os.Args, execSpec)
+	pid, err = m.cgroup.forkExec(os.Args[0], os.Args, execSpec)
+	w.Close()
 	if err != nil {
 		log.Error(err)
+		r.Close()
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
 		return
 	}
+	m.output.capture(pid, int(atomic.LoadInt32(&m.generation)), r)
 	file := os.NewFile(uintptr(fds[0]), "")
-	conn, _ := net.FileConn(file)
-	uc, _ := conn.(*net.UnixConn)
-	m.uc.Store(pid, uc)
+	c, _ := net.FileConn(file)
+	uc, _ := c.(*net.UnixConn)
+	file.Close()
+	if err = socket.SendListeners(uc, m.addr); err != nil {
+		log.Errorf("SendListeners\tPid=%d\tErr=%s\n", pid, err.Error())
+	}
+	conn := newMsgConn(uc)
+	m.conns.Store(pid, conn)
 	m.children.Store(pid, workerAlive)
+	m.slots.Store(pid, slot)
+	m.current.Store(slot, pid)
+	m.started.Store(pid, time.Now())
+	m.slotState(slot).start()
+	if reason == reasonReload {
+		m.awaitReady(pid, slot)
+	}
 	syscall.Close(fds[1])
 
 	m.forkWG.Add(1)
@@ -228,7 +477,7 @@ func (m *master) fork(reason string) (pid int, err error) {
 		m.waitWorker(pid)
 		m.forkWG.Done()
 	}()
-	go m.readMsg(pid, uc)
+	go m.readMsg(pid, conn)
 
 	return
 }
@@ -237,6 +486,16 @@ func (m *master) waitWorker(pid int) {
 	p, _ := os.FindProcess(pid)
 	state, _ := p.Wait()
 	status := state.Sys().(syscall.WaitStatus)
+	m.keepOld(pid)
+	m.probationFailed(pid)
+	if m.cgroup != nil {
+		m.cgroup.remove(pid)
+	}
+	slot, ok := m.slots.Load(pid)
+	if ok {
+		m.slotState(slot.(int)).exit(state.String())
+		m.output.exited(pid, slot.(int), state.String(), status.ExitStatus() != 0)
+	}
 	if status.ExitStatus() != 0 {
 		m.children.Store(pid, workerCrash)
 		log.Errorf("WorkerCrash\tPid=%d\tStatus=%d\n", pid, status.ExitStatus())
@@ -256,30 +515,63 @@ func (m *master) waitWorker(pid int) {
 	*/
 }
 
-func (m *master) readMsg(pid int, uc *net.UnixConn) {
+func (m *master) readMsg(pid int, conn *msgConn) {
 	for {
-		msg, err := readMsg(uc, "master", m.pid)
+		msg, err := conn.read("master", m.pid)
 		if err != nil {
 			break
 		}
 		switch msg.Typ {
 		case msgTakeover:
-			m.notifyWorker(&message{Typ: msgQuit}, workerReload)
+			slot, _ := m.slots.Load(pid)
+			m.workerReady(pid, slot.(int))
+			if m.ready(pid) {
+				m.probate(pid, slot.(int))
+			}
 			log.Infof("ReadMsg\tPid=%d\tMsg=%s\n", pid, msg.Typ)
+			m.upgradeTakeover()
+		case msgReady:
+			slot, _ := m.slots.Load(pid)
+			m.workerReady(pid, slot.(int))
+		case msgCustom:
+			go conn.handleCustom(msg)
 		}
 	}
 }
 
-func (m *master) reload() {
-	for i := 0; i < workerNum; i++ {
-		m.forkC <- reasonReload
+// reload replaces all the workers, done gets false if the reload is aborted
+// or any slot keeps its old worker, see probation.go.
+func (m *master) reload(done chan<- bool) {
+	err := m.hooks.run("OnBeforeReload", m.hooks.beforeReload,
+		m.event(reasonReload))
+	if err != nil {
+		log.Errorf("ReloadAbort\tPid=%d\n", m.pid)
+		if done != nil {
+			done <- false
+		}
+		return
+	}
+	atomic.AddInt32(&m.generation, 1)
+	n := m.numWorkers()
+	m.reloadBegin(n, done)
+	for i := 0; i < n; i++ {
+		m.forkC <- forkReq{reasonReload, i}
 	}
 }
 
 func (m *master) notifyWorker(msg *message, states ...workerState) {
+	m.notifySlot(-1, msg, states...)
+}
+
+// notifySlot sends msg to the workers of slot in one of states,
+// slot < 0 means all slots.
+func (m *master) notifySlot(slot int, msg *message, states ...workerState) {
 	f := func(key, value interface{}) bool {
 		pid := key.(int)
 		curState := value.(workerState)
+		if s, ok := m.slots.Load(pid); slot >= 0 && (!ok || s.(int) != slot) {
+			return true
+		}
 		match := false
 		for _, state := range states {
 			if curState == state {
@@ -290,13 +582,14 @@ func (m *master) notifyWorker(msg *message, states ...workerState) {
 		if !match {
 			return true
 		}
-		if uc, ok := m.uc.Load(pid); !ok {
+		if conn, ok := m.conns.Load(pid); !ok {
 			log.Errorf("NotInUnixConn\tPid=%d\n", pid)
 			return true
 		} else {
-			var buf bytes.Buffer
-			gob.NewEncoder(&buf).Encode(msg)
-			if _, _, err := uc.(*net.UnixConn).WriteMsgUnix(buf.Bytes(), nil, nil); err != nil {
+			if msg.Typ == msgQuit {
+				m.killAfter(pid)
+			}
+			if err := conn.(*msgConn).write(msg); err != nil {
 				log.Warnf("WriteMsg\tPid=%d\tErr=%s\n", pid, err.Error())
 			} else {
 				log.Infof("WriteMsg\tPid=%d\tMsg=%s\n", pid, msg.Typ)
@@ -307,32 +600,160 @@ func (m *master) notifyWorker(msg *message, states ...workerState) {
 	m.children.Range(f)
 }
 
+// broadcast sends a copy of msg to all alive workers concurrently and
+// collects their replies.
+func (m *master) broadcast(msg message, timeout time.Duration) []Reply {
+	var pids []int
+	m.children.Range(func(key, state interface{}) bool {
+		if state.(workerState) == workerAlive {
+			pids = append(pids, key.(int))
+		}
+		return true
+	})
+	return m.request(pids, msg, timeout)
+}
+
+// request sends msg to the workers pids and waits up to timeout for their
+// replies, sorted by pid.
+func (m *master) request(pids []int, msg message,
+	timeout time.Duration) []Reply {
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		replies []Reply
+	)
+	for _, pid := range pids {
+		conn, ok := m.conns.Load(pid)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(pid int) {
+			defer wg.Done()
+			req := msg
+			r := Reply{Pid: pid}
+			if rsp, err := conn.(*msgConn).request(&req, timeout); err != nil {
+				r.Err = err
+			} else {
+				r.Value = rsp.Value
+			}
+			mu.Lock()
+			replies = append(replies, r)
+			mu.Unlock()
+		}(pid)
+	}
+	wg.Wait()
+	sort.Slice(replies, func(i, j int) bool {
+		return replies[i].Pid < replies[j].Pid
+	})
+	return replies
+}
+
 func (m *master) graceful() {
+	atomic.StoreInt32(&m.closing, 1)
 	m.notifyWorker(&message{Typ: msgQuit}, workerAlive, workerReload)
 	m.forkWG.Wait()
 }
 
 func (m *master) close() {
+	m.hooks.run("OnShutdown", m.hooks.shutdown, m.event(reasonShutdown))
 	m.removePID()
+	// after upgrade the socket files belong to the new master.
+	if !strings.HasSuffix(m.pidPath, ".oldbin") {
+		socket.RemoveUnix()
+	}
 	log.Infof("MasterEnd\tPid=%d\n", m.pid)
 }
 
-func (m *master) serve() {
+func (m *master) serve(lis net.Listener) {
 	http.HandleFunc("/stats", m.doStats)
-	if err := http.ListenAndServe(m.addr, nil); err != nil {
+	m.handleCtl()
+	srv := &http.Server{Handler: http.DefaultServeMux}
+	if err := srv.Serve(lis); err != nil {
 		log.Fatal(err)
 	}
 }
 
+type workerStats struct {
+	Pid      int    `json:"pid"`
+	Slot     int    `json:"slot"`
+	State    string `json:"state"`
+	Restarts int    `json:"restarts"`
+	Backoff  string `json:"backoff,omitempty"`
+	LastExit string `json:"lastExit,omitempty"`
+	Latency  string `json:"latency,omitempty"`
+	Misses   int    `json:"misses"`
+	Uptime   string `json:"uptime,omitempty"`
+
+	// sampled by the recycle policy, -1 if unknown
+	RSS        int64 `json:"rss,omitempty"`
+	Goroutines int   `json:"goroutines,omitempty"`
+	Requests   int64 `json:"requests,omitempty"`
+
+	// reported for the scale policy
+	QPS      int     `json:"qps,omitempty"`
+	Inflight int64   `json:"inflight,omitempty"`
+	CPU      float64 `json:"cpu,omitempty"`
+}
+
+// masterStats is the response of /stats of the master.
+type masterStats struct {
+	Worker    map[string]int `json:"worker"`
+	Workers   []workerStats  `json:"workers"`
+	WorkerNum int            `json:"workerNum"`
+	Recycle   int            `json:"recycle"`
+	Recycles  []recycleStats `json:"recycles"`
+}
+
 func (m *master) doStats(rsp http.ResponseWriter, req *http.Request) {
-	var jsonRsp struct {
-		Worker map[string]int `json:"worker"`
-	}
+	var jsonRsp masterStats
 	jsonRsp.Worker = make(map[string]int)
 	m.forkStats.Range(func(key, value interface{}) bool {
 		jsonRsp.Worker[key.(string)] = value.(int)
 		return true
 	})
+	jsonRsp.Workers = m.workerStats()
+	jsonRsp.WorkerNum = m.numWorkers()
+	jsonRsp.Recycle, jsonRsp.Recycles = m.recycles.stats()
 	out, _ := json.Marshal(jsonRsp)
 	rsp.Write(out)
 }
+
+func (m *master) workerStats() (workers []workerStats) {
+	m.children.Range(func(key, value interface{}) bool {
+		ws := workerStats{
+			Pid:   key.(int),
+			State: value.(workerState).String(),
+		}
+		if t, ok := m.started.Load(ws.Pid); ok {
+			ws.Uptime = time.Since(t.(time.Time)).Truncate(time.Second).String()
+		}
+		if slot, ok := m.slots.Load(ws.Pid); ok {
+			ws.Slot = slot.(int)
+			m.slotState(ws.Slot).fill(&ws)
+		}
+		if l, ok := m.liveness.Load(ws.Pid); ok {
+			l.(*liveness).fill(&ws)
+		}
+		if u, ok := m.usages.Load(ws.Pid); ok {
+			u := u.(usage)
+			ws.RSS, ws.Goroutines, ws.Requests = u.RSS, u.Goroutines, u.Requests
+			ws.QPS, ws.Inflight, ws.CPU = u.QPS, u.Inflight, u.CPU
+		}
+		workers = append(workers, ws)
+		return true
+	})
+	// slots waiting for restart or given up have no worker
+	for slot := 0; slot < m.numWorkers(); slot++ {
+		if s := m.slotState(slot); s.waiting() {
+			ws := workerStats{Slot: slot, State: "down"}
+			s.fill(&ws)
+			workers = append(workers, ws)
+		}
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].Slot < workers[j].Slot
+	})
+	return
+}
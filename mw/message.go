@@ -1,19 +1,55 @@
 package mw
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/tddhit/tools/log"
 )
 
+// Messages between master and worker, or old and new master during upgrade,
+// are framed on the socketpair after the listener handoff:
+//
+//	| version 1 byte | length 4 bytes big-endian | gob-encoded message |
+//
+// A message with a non-zero ID expects a reply, whose ReplyTo is that ID.
+
+const (
+	msgVersion   = 1
+	msgHeaderLen = 5
+	maxMsgLen    = 16 << 20
+)
+
+var (
+	errMsgVersion = errors.New("unsupported message version")
+	errMsgTooLong = errors.New("message too long")
+	errMsgTimeout = errors.New("message timeout")
+	errMsgClosed  = errors.New("message conn closed")
+	errNoHandler  = errors.New("no message handler")
+)
+
 type msgType int
 
 const (
-	msgTakeover msgType = iota // worker->master
-	msgQuit                    // master->worker
+	msgTakeover     msgType = iota // worker->master
+	msgQuit                        // master->worker
+	msgUpgradeReady                // new master->old master
+	msgPing                        // master->worker
+	msgPong                        // worker->master
+	msgCustom                      // both, see HandleMsg
+	msgReply                       // both, reply of msgCustom
+	msgConfig                      // master->worker, see OnConfigChange
+	msgReady                       // worker->master, see systemd.go
+	msgStats                       // master->worker, see recycle.go
 )
 
 func (m msgType) String() string {
@@ -22,25 +58,251 @@ func (m msgType) String() string {
 		return "takeover"
 	case msgQuit:
 		return "quit"
+	case msgUpgradeReady:
+		return "upgradeReady"
+	case msgPing:
+		return "ping"
+	case msgPong:
+		return "pong"
+	case msgCustom:
+		return "custom"
+	case msgReply:
+		return "reply"
+	case msgConfig:
+		return "config"
+	case msgReady:
+		return "ready"
+	case msgStats:
+		return "stats"
 	default:
 		return fmt.Sprintf("unknown msg type:%d", m)
 	}
 }
 
 type message struct {
-	Typ   msgType
-	Value interface{}
+	Typ     msgType
+	ID      uint64 // non-zero if a reply is expected
+	ReplyTo uint64 // ID of the request answered by this message
+	Name    string // name of a custom message
+	Value   []byte
+	Err     string
 }
 
-func readMsg(conn *net.UnixConn, id string, pid int) (*message, error) {
-	buf := make([]byte, 1024)
-	msg := &message{}
-	if _, _, _, _, err := conn.ReadMsgUnix(buf, nil); err != nil {
-		log.Warnf("ReadMsg\tId=%s\tPid=%d\tErr=%s\n", id, pid, err.Error())
+// msgConn reads and writes framed messages, and matches replies with the
+// requests waiting for them.
+type msgConn struct {
+	uc      *net.UnixConn
+	r       *bufio.Reader
+	wmu     sync.Mutex
+	id      uint64
+	pending sync.Map // key: ID, value: chan *message
+}
+
+func newMsgConn(uc *net.UnixConn) *msgConn {
+	return &msgConn{
+		uc: uc,
+		r:  bufio.NewReader(uc),
+	}
+}
+
+func (c *msgConn) write(msg *message) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, msgHeaderLen))
+	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	if len(b)-msgHeaderLen > maxMsgLen {
+		return errMsgTooLong
+	}
+	b[0] = msgVersion
+	binary.BigEndian.PutUint32(b[1:], uint32(len(b)-msgHeaderLen))
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.uc.Write(b)
+	return err
+}
+
+func (c *msgConn) readFrame() (*message, error) {
+	head := make([]byte, msgHeaderLen)
+	if _, err := io.ReadFull(c.r, head); err != nil {
 		return nil, err
 	}
-	if err := gob.NewDecoder(bytes.NewBuffer(buf)).Decode(msg); err != nil {
+	if head[0] != msgVersion {
+		return nil, errMsgVersion
+	}
+	n := binary.BigEndian.Uint32(head[1:])
+	if n > maxMsgLen {
+		return nil, errMsgTooLong
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return nil, err
+	}
+	msg := &message{}
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(msg); err != nil {
 		return nil, err
 	}
 	return msg, nil
 }
+
+// read returns the next message which is not a reply. Replies are handed to
+// the requests waiting for them. Once read fails, the pending requests fail
+// with errMsgClosed.
+func (c *msgConn) read(id string, pid int) (*message, error) {
+	for {
+		msg, err := c.readFrame()
+		if err != nil {
+			log.Warnf("ReadMsg\tId=%s\tPid=%d\tErr=%s\n", id, pid, err.Error())
+			c.pending.Range(func(key, value interface{}) bool {
+				c.pending.Delete(key)
+				close(value.(chan *message))
+				return true
+			})
+			return nil, err
+		}
+		if msg.ReplyTo == 0 {
+			return msg, nil
+		}
+		if ch, ok := c.pending.Load(msg.ReplyTo); ok {
+			c.pending.Delete(msg.ReplyTo)
+			ch.(chan *message) <- msg
+		}
+	}
+}
+
+// request writes msg and waits up to timeout for its reply. Some other
+// goroutine must be calling read.
+func (c *msgConn) request(msg *message, timeout time.Duration) (*message, error) {
+	msg.ID = atomic.AddUint64(&c.id, 1)
+	ch := make(chan *message, 1)
+	c.pending.Store(msg.ID, ch)
+	defer c.pending.Delete(msg.ID)
+
+	if err := c.write(msg); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case rsp, ok := <-ch:
+		if !ok {
+			return nil, errMsgClosed
+		}
+		if rsp.Err != "" {
+			return rsp, errors.New(rsp.Err)
+		}
+		return rsp, nil
+	case <-timer.C:
+		return nil, errMsgTimeout
+	}
+}
+
+func (c *msgConn) reply(req, rsp *message) error {
+	rsp.ReplyTo = req.ID
+	return c.write(rsp)
+}
+
+// handleCustom runs the handler of a custom message and replies its result.
+func (c *msgConn) handleCustom(req *message) {
+	rsp := &message{Typ: msgReply, Name: req.Name}
+	if value, err := runHandler(req.Name, req.Value); err != nil {
+		rsp.Err = err.Error()
+	} else {
+		rsp.Value = value
+	}
+	if req.ID == 0 {
+		return
+	}
+	if err := c.reply(req, rsp); err != nil {
+		log.Warnf("WriteMsg\tName=%s\tErr=%s\n", req.Name, err.Error())
+	}
+}
+
+func (c *msgConn) close() error {
+	return c.uc.Close()
+}
+
+// MsgHandler handles a custom message and returns the value replied to the
+// sender.
+type MsgHandler func(value []byte) ([]byte, error)
+
+// key: name, value: MsgHandler
+var handlers sync.Map
+
+// HandleMsg registers h for the custom messages called name. Workers handle
+// the messages sent by Broadcast, the master handles the ones sent by
+// Request. It must be called before Go.
+func HandleMsg(name string, h MsgHandler) {
+	handlers.Store(name, h)
+}
+
+func runHandler(name string, value []byte) ([]byte, error) {
+	h, ok := handlers.Load(name)
+	if !ok {
+		return nil, errors.New(errNoHandler.Error() + ": " + name)
+	}
+	return h.(MsgHandler)(value)
+}
+
+// Reply is the answer of a worker to Broadcast.
+type Reply struct {
+	Pid   int
+	Value []byte
+	Err   error
+}
+
+// Broadcast sends the custom message name to all alive workers and waits up
+// to timeout for their replies. It can only be called in the master.
+func (f *MW) Broadcast(name string, value []byte,
+	timeout time.Duration) ([]Reply, error) {
+
+	if f.master == nil {
+		return nil, errors.New("Broadcast must be called in master")
+	}
+	msg := message{Typ: msgCustom, Name: name, Value: value}
+	return f.master.broadcast(msg, timeout), nil
+}
+
+// Request sends the custom message name to the master and waits up to
+// timeout for its reply. It can only be called in a worker. Without fork the
+// process is its own master and runs the handler itself.
+func (f *MW) Request(name string, value []byte,
+	timeout time.Duration) ([]byte, error) {
+
+	if f.worker == nil {
+		return nil, errors.New("Request must be called in worker")
+	}
+	if f.worker.conn == nil {
+		return requestSelf(name, value, timeout)
+	}
+	msg := &message{Typ: msgCustom, Name: name, Value: value}
+	rsp, err := f.worker.conn.request(msg, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return rsp.Value, nil
+}
+
+func requestSelf(name string, value []byte,
+	timeout time.Duration) ([]byte, error) {
+
+	type result struct {
+		value []byte
+		err   error
+	}
+	c := make(chan result, 1)
+	go func() {
+		value, err := runHandler(name, value)
+		c <- result{value, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-c:
+		return r.value, r.err
+	case <-timer.C:
+		return nil, errMsgTimeout
+	}
+}
@@ -0,0 +1,213 @@
+package mw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// msgPair returns the two ends of a socketpair, as master and worker.
+func msgPair(t *testing.T) (*msgConn, *msgConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]*msgConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "msg")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = newMsgConn(c.(*net.UnixConn))
+		t.Cleanup(func() { c.Close() })
+	}
+	return conns[0], conns[1]
+}
+
+func frame(t *testing.T, msg *message) []byte {
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(msg); err != nil {
+		t.Fatal(err)
+	}
+	head := make([]byte, msgHeaderLen)
+	head[0] = msgVersion
+	binary.BigEndian.PutUint32(head[1:], uint32(body.Len()))
+	return append(head, body.Bytes()...)
+}
+
+func TestMsgSplitFrame(t *testing.T) {
+	a, b := msgPair(t)
+	want := &message{Typ: msgCustom, Name: "conf", Value: []byte("v")}
+	b1 := frame(t, want)
+	b2 := frame(t, &message{Typ: msgQuit})
+	// the header split, then the rest of the first frame with the second.
+	go func() {
+		a.uc.Write(b1[:3])
+		time.Sleep(20 * time.Millisecond)
+		a.uc.Write(b1[3:10])
+		time.Sleep(20 * time.Millisecond)
+		a.uc.Write(append(b1[10:], b2...))
+	}()
+	msg, err := b.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Typ != want.Typ || msg.Name != want.Name ||
+		string(msg.Value) != string(want.Value) {
+
+		t.Fatalf("got %+v, want %+v", msg, want)
+	}
+	if msg, err = b.readFrame(); err != nil || msg.Typ != msgQuit {
+		t.Fatalf("got %+v, %v, want quit", msg, err)
+	}
+}
+
+func TestMsgBadHeader(t *testing.T) {
+	tests := []struct {
+		head []byte
+		err  error
+	}{
+		{[]byte{msgVersion, 0xff, 0xff, 0xff, 0xff}, errMsgTooLong},
+		{[]byte{msgVersion, 0x01, 0x00, 0x00, 0x01}, errMsgTooLong},
+		{[]byte{msgVersion + 1, 0, 0, 0, 1}, errMsgVersion},
+		{[]byte{0, 0, 0, 0, 1}, errMsgVersion},
+	}
+	for _, tt := range tests {
+		a, b := msgPair(t)
+		if _, err := a.uc.Write(tt.head); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.readFrame(); err != tt.err {
+			t.Errorf("readFrame(% x) = %v, want %v", tt.head, err, tt.err)
+		}
+	}
+
+	a, _ := msgPair(t)
+	big := &message{Typ: msgCustom, Value: make([]byte, maxMsgLen+1)}
+	if err := a.write(big); err != errMsgTooLong {
+		t.Fatalf("write of %d bytes = %v, want %v", maxMsgLen+1, err, errMsgTooLong)
+	}
+}
+
+func TestMsgRequestReply(t *testing.T) {
+	master, worker := msgPair(t)
+	next := make(chan *message, 1)
+	go func() {
+		msg, _ := master.read("master", 0)
+		next <- msg
+	}()
+
+	// the worker holds both requests and replies them in reverse order.
+	reqs := make(chan *message, 2)
+	go func() {
+		for {
+			msg, err := worker.read("worker", 0)
+			if err != nil {
+				return
+			}
+			reqs <- msg
+		}
+	}()
+	type result struct {
+		rsp *message
+		err error
+	}
+	results := make([]chan result, 2)
+	for i, name := range []string{"first", "second"} {
+		results[i] = make(chan result, 1)
+		go func(i int, name string) {
+			rsp, err := master.request(&message{Typ: msgCustom, Name: name},
+				time.Second)
+			results[i] <- result{rsp, err}
+		}(i, name)
+		// keeps the order of the requests.
+		time.Sleep(20 * time.Millisecond)
+	}
+	r1, r2 := <-reqs, <-reqs
+	if r1.ID == 0 || r2.ID == 0 || r1.ID == r2.ID {
+		t.Fatalf("request IDs %d and %d", r1.ID, r2.ID)
+	}
+	worker.reply(r2, &message{Typ: msgReply, Value: []byte(r2.Name)})
+	worker.reply(r1, &message{Typ: msgReply, Err: "failed " + r1.Name})
+
+	res := <-results[0]
+	if res.err == nil || res.err.Error() != "failed first" {
+		t.Errorf("first: got %+v, %v", res.rsp, res.err)
+	}
+	res = <-results[1]
+	if res.err != nil || string(res.rsp.Value) != "second" {
+		t.Errorf("second: got %+v, %v", res.rsp, res.err)
+	}
+
+	// a reply nobody waits for is dropped, read returns the next message.
+	worker.write(&message{Typ: msgReply, ReplyTo: 12345})
+	worker.write(&message{Typ: msgPing})
+	if msg := <-next; msg == nil || msg.Typ != msgPing {
+		t.Fatalf("read = %+v, want ping", msg)
+	}
+}
+
+func TestMsgTimeout(t *testing.T) {
+	master, worker := msgPair(t)
+	go master.read("master", 0)
+	go worker.read("worker", 0) // never replies
+
+	start := time.Now()
+	_, err := master.request(&message{Typ: msgCustom}, 50*time.Millisecond)
+	if err != errMsgTimeout {
+		t.Fatalf("got %v, want %v", err, errMsgTimeout)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > time.Second {
+		t.Fatalf("timed out after %s", d)
+	}
+	if n := pendingLen(master); n != 0 {
+		t.Fatalf("%d requests left pending", n)
+	}
+}
+
+func TestMsgClosed(t *testing.T) {
+	master, worker := msgPair(t)
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := master.read("master", 0)
+		readErr <- err
+	}()
+	done := make(chan error, 1)
+	go func() {
+		_, err := master.request(&message{Typ: msgCustom}, 5*time.Second)
+		done <- err
+	}()
+	// the worker exits with the request pending.
+	if _, err := worker.readFrame(); err != nil {
+		t.Fatal(err)
+	}
+	worker.close()
+	select {
+	case err := <-done:
+		if err != errMsgClosed {
+			t.Fatalf("got %v, want %v", err, errMsgClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request not failed on EOF")
+	}
+	if err := <-readErr; err != io.EOF {
+		t.Fatalf("read = %v, want EOF", err)
+	}
+}
+
+func pendingLen(c *msgConn) int {
+	n := 0
+	c.pending.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
@@ -3,9 +3,12 @@ package mw
 import (
 	"context"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/tddhit/box/confcenter"
 	"github.com/tddhit/box/mw/common"
@@ -20,11 +23,34 @@ type MW struct {
 	masterAddr string
 	workerAddr string
 	pidPath    string
-	master     *master
-	worker     *worker
+	workerNum  int
 
-	servers    []*transport.Server
-	confCenter *confcenter.ConfCenter
+	upgradeTimeout  time.Duration
+	shutdownTimeout time.Duration
+	restartPolicy   *RestartPolicy
+	livenessPolicy  *LivenessPolicy
+	outputPolicy    *OutputPolicy
+	recyclePolicy   *RecyclePolicy
+	scalePolicy     *ScalePolicy
+	ctlToken        string
+
+	warmups          []func(ctx context.Context) error
+	readinessCheck   func(ctx context.Context) error
+	readinessTimeout time.Duration
+	probation        *time.Duration
+	limits           *Limits
+	hookTimeout      time.Duration
+	hooks            *hooks
+
+	master *master
+	worker *worker
+
+	noFork          bool
+	daemon          bool
+	servers         []*transport.Server
+	confCenter      *confcenter.ConfCenter
+	confValidator   func(raw []byte) error
+	confRestartKeys []string
 }
 
 func New(opts ...Option) *MW {
@@ -33,29 +59,75 @@ func New(opts ...Option) *MW {
 		opt(f)
 	}
 	if f.masterAddr != "" {
-		s := strings.Split(f.masterAddr, ":")
-		if len(s) != 2 {
+		ip, _, err := net.SplitHostPort(f.masterAddr)
+		if err != nil {
 			log.Fatal("invalid masterAddr")
 		}
-		ip := s[0]
 		if ip == "" {
 			f.masterAddr = util.GetLocalAddr(f.masterAddr)
 		}
 	} else if f.servers != nil {
-		f.masterAddr = getDefaultAddr(f.servers[len(f.servers)-1].Addr(), 2)
+		f.masterAddr = getDefaultAddr(f.servers, 2)
 	}
 	if f.workerAddr != "" {
-		s := strings.Split(f.workerAddr, ":")
-		if len(s) != 2 {
+		ip, _, err := net.SplitHostPort(f.workerAddr)
+		if err != nil {
 			log.Fatal("invalid workerAddr")
 		}
-		ip := s[0]
 		if ip == "" {
 			f.workerAddr = util.GetLocalAddr(f.workerAddr)
 		}
 	} else if f.servers != nil {
-		f.workerAddr = getDefaultAddr(f.servers[len(f.servers)-1].Addr(), 1)
+		f.workerAddr = getDefaultAddr(f.servers, 1)
+	}
+	if f.workerNum <= 0 {
+		f.workerNum = 1
+	}
+	if f.upgradeTimeout <= 0 {
+		f.upgradeTimeout = defaultUpgradeTimeout
+	}
+	if f.shutdownTimeout <= 0 {
+		f.shutdownTimeout = defaultShutdownTimeout
+	}
+	if f.readinessTimeout <= 0 {
+		f.readinessTimeout = defaultReadinessTimeout
+	}
+	if f.probation == nil {
+		d := defaultProbation
+		f.probation = &d
+	}
+	if f.hookTimeout <= 0 {
+		f.hookTimeout = defaultHookTimeout
+	}
+	f.hooks = &hooks{timeout: f.hookTimeout}
+	if f.restartPolicy == nil {
+		p := defaultRestartPolicy
+		f.restartPolicy = &p
+	}
+	f.restartPolicy.fill()
+	if f.livenessPolicy == nil {
+		p := defaultLivenessPolicy
+		f.livenessPolicy = &p
+	}
+	f.livenessPolicy.fill()
+	if f.recyclePolicy == nil {
+		p := defaultRecyclePolicy
+		f.recyclePolicy = &p
+	}
+	f.recyclePolicy.fill()
+	if f.scalePolicy == nil {
+		p := defaultScalePolicy
+		f.scalePolicy = &p
 	}
+	f.scalePolicy.fill()
+	if f.scalePolicy.enabled() {
+		f.workerNum = f.scalePolicy.clamp(f.workerNum)
+	}
+	if f.outputPolicy == nil {
+		p := defaultOutputPolicy
+		f.outputPolicy = &p
+	}
+	f.outputPolicy.fill()
 	if f.pidPath == "" {
 		name := strings.Split(os.Args[0], "/")
 		if len(name) == 0 {
@@ -63,9 +135,16 @@ func New(opts ...Option) *MW {
 		}
 		f.pidPath = fmt.Sprintf("./%s.pid", name[len(name)-1])
 	}
+	if f.noFork {
+		atomic.StoreInt32(&noFork, 1)
+	}
+	if f.daemon && !IsWorker() && !isDaemon() &&
+		os.Getenv(common.UPGRADE) != "1" {
+		daemonize(f.pidPath)
+	}
 	baseCtx := context.Background()
 	ctx := context.WithValue(baseCtx, mwKey{}, f)
-	if os.Getenv(common.FORK) == "1" {
+	if IsWorker() {
 		f.worker = newWorker(ctx)
 	} else {
 		f.master = newMaster(ctx)
@@ -74,15 +153,36 @@ func New(opts ...Option) *MW {
 }
 
 func (f *MW) Go() {
-	if os.Getenv(common.FORK) == "1" {
+	if f.worker != nil {
 		f.worker.run()
 	} else {
 		f.master.run()
 	}
 }
 
+// Stop shuts down gracefully as SIGQUIT does, Go returns once it is done.
+// It does nothing in a forked worker, whose lifecycle belongs to the master.
+func (f *MW) Stop() {
+	switch {
+	case f.master != nil:
+		f.master.stop()
+	case f.worker.conn == nil:
+		f.worker.close()
+	}
+}
+
+// set by WithoutFork
+var noFork int32
+
+// IsWorker reports whether the process serves requests itself, either as a
+// forked worker or in single-process mode. Set the env box-nofork=1 instead
+// of WithoutFork if IsWorker is called before New.
 func IsWorker() bool {
-	return os.Getenv(common.FORK) == "1"
+	return os.Getenv(common.FORK) == "1" || singleProcess()
+}
+
+func singleProcess() bool {
+	return os.Getenv(common.NOFORK) == "1" || atomic.LoadInt32(&noFork) == 1
 }
 
 func Run(opts ...Option) {
@@ -90,11 +190,21 @@ func Run(opts ...Option) {
 	f.Go()
 }
 
-// get default masterAddr/workerAddr.
+// get default masterAddr/workerAddr from the last tcp server.
 // eg. transportAddr:80, workerAddr:81, masterAddr:82
-func getDefaultAddr(addr string, n int) string {
-	a := strings.Split(addr, ":")
-	port, _ := strconv.Atoi(a[len(a)-1])
-	a[len(a)-1] = strconv.Itoa(port + n)
-	return strings.Join(a, ":")
+func getDefaultAddr(servers []*transport.Server, n int) string {
+	var addr string
+	for i := len(servers) - 1; i >= 0; i-- {
+		if servers[i].Network() == "tcp" {
+			addr = servers[i].Addr()
+			break
+		}
+	}
+	if addr == "" {
+		log.Fatal("WithMasterAddr and WithWorkerAddr are required when " +
+			"every server listens on a unix domain socket")
+	}
+	host, p, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(p)
+	return net.JoinHostPort(host, strconv.Itoa(port+n))
 }
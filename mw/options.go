@@ -1,7 +1,11 @@
 package mw
 
 import (
+	"context"
+	"time"
+
 	"github.com/tddhit/box/confcenter"
+	"github.com/tddhit/box/option"
 	"github.com/tddhit/box/transport"
 )
 
@@ -31,8 +35,175 @@ func WithConfCenter(c *confcenter.ConfCenter) Option {
 	}
 }
 
+// WithConfigValidator checks a new config of the confcenter in the master
+// before it is pushed to the workers, an invalid config is ignored.
+func WithConfigValidator(v func(raw []byte) error) Option {
+	return func(f *MW) {
+		f.confValidator = v
+	}
+}
+
+// WithConfigRestartKeys sets the top-level config keys that can't be
+// applied by OnConfigChange, a change of them reloads the workers.
+func WithConfigRestartKeys(keys ...string) Option {
+	return func(f *MW) {
+		f.confRestartKeys = append(f.confRestartKeys, keys...)
+	}
+}
+
 func WithServer(s *transport.Server) Option {
 	return func(f *MW) {
 		f.servers = append(f.servers, s)
 	}
 }
+
+func WithWorkerNum(n int) Option {
+	return func(f *MW) {
+		f.workerNum = n
+	}
+}
+
+// WithoutFork serves in the calling process instead of forking workers,
+// e.g. under go test or a debugger. The env box-nofork=1 does the same.
+func WithoutFork() Option {
+	return func(f *MW) {
+		f.noFork = true
+	}
+}
+
+// WithDaemon detaches the master from the terminal: it is started again in
+// a new session with stdin, stdout and stderr on /dev/null, and the calling
+// process exits once the new master holds the pid file. Set up a log file
+// to keep the logs. It is ignored in single-process mode.
+func WithDaemon() Option {
+	return func(f *MW) {
+		f.daemon = true
+	}
+}
+
+// WithUpgradeTimeout sets how long the old master waits for the new one
+// on SIGUSR2 before rolling back.
+func WithUpgradeTimeout(d time.Duration) Option {
+	return func(f *MW) {
+		f.upgradeTimeout = d
+	}
+}
+
+// WithShutdownTimeout bounds the graceful shutdown of a worker, the master
+// kills a worker that is still running after it.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(f *MW) {
+		f.shutdownTimeout = d
+	}
+}
+
+// WithWarmup adds a hook run by a new worker before it is ready, e.g. to
+// fill caches or connect to dependencies.
+func WithWarmup(h func(ctx context.Context) error) Option {
+	return func(f *MW) {
+		f.warmups = append(f.warmups, h)
+	}
+}
+
+// WithReadinessCheck sets the check polled by a new worker after the warmup
+// hooks, the worker takes over once it passes.
+func WithReadinessCheck(c func(ctx context.Context) error) Option {
+	return func(f *MW) {
+		f.readinessCheck = c
+	}
+}
+
+// WithReadinessTimeout bounds the warmup and readiness check of a new worker.
+func WithReadinessTimeout(d time.Duration) Option {
+	return func(f *MW) {
+		f.readinessTimeout = d
+	}
+}
+
+// WithLimits sets the resource limits and the user of every worker.
+func WithLimits(l Limits) Option {
+	return func(f *MW) {
+		f.limits = &l
+	}
+}
+
+// WithHookTimeout bounds each lifecycle hook, a hook running longer fails.
+func WithHookTimeout(d time.Duration) Option {
+	return func(f *MW) {
+		f.hookTimeout = d
+	}
+}
+
+// WithRestartPolicy replaces the default policy used to restart crashed
+// workers.
+func WithRestartPolicy(p RestartPolicy) Option {
+	return func(f *MW) {
+		f.restartPolicy = &p
+	}
+}
+
+// WithProbation sets how long the new worker of a reload must stay up before
+// the old one is retired, 0 retires it right at takeover.
+func WithProbation(d time.Duration) Option {
+	return func(f *MW) {
+		f.probation = &d
+	}
+}
+
+// WithRecyclePolicy enables replacing the workers that pass a memory,
+// goroutine, lifetime or request threshold.
+func WithRecyclePolicy(p RecyclePolicy) Option {
+	return func(f *MW) {
+		f.recyclePolicy = &p
+	}
+}
+
+// WithScalePolicy lets the master grow and shrink the workers between Min
+// and Max following the load, WithWorkerNum sets the initial number.
+func WithScalePolicy(p ScalePolicy) Option {
+	return func(f *MW) {
+		f.scalePolicy = &p
+	}
+}
+
+// WithOutputPolicy sets where the master writes the output of the workers,
+// and how much of it is kept for crashed workers.
+func WithOutputPolicy(p OutputPolicy) Option {
+	return func(f *MW) {
+		f.outputPolicy = &p
+	}
+}
+
+// WithLivenessPolicy enables killing workers that stop answering the
+// master's heartbeat.
+func WithLivenessPolicy(p LivenessPolicy) Option {
+	return func(f *MW) {
+		f.livenessPolicy = &p
+	}
+}
+
+// WithControlToken protects the master control API with a bearer token.
+func WithControlToken(t string) Option {
+	return func(f *MW) {
+		f.ctlToken = t
+	}
+}
+
+// WithServerConf applies the master-worker fields of a yaml server config,
+// empty fields are ignored.
+func WithServerConf(c option.Server) Option {
+	return func(f *MW) {
+		if c.MasterAddr != "" {
+			f.masterAddr = c.MasterAddr
+		}
+		if c.WorkerAddr != "" {
+			f.workerAddr = c.WorkerAddr
+		}
+		if c.PIDPath != "" {
+			f.pidPath = c.PIDPath
+		}
+		if c.WorkerNum > 0 {
+			f.workerNum = c.WorkerNum
+		}
+	}
+}
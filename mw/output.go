@@ -0,0 +1,262 @@
+package mw
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tddhit/tools/log"
+)
+
+// The stdout and stderr of every worker are piped to the master, which
+// prefixes each line with the worker pid and generation and writes it to
+// OutputPolicy.Path, or to its own stderr. The last lines of every worker are
+// kept, those of the latest crashed workers are served by GET /ctl/crashes.
+type OutputPolicy struct {
+	Path       string // empty means the stderr of the master
+	MaxSize    int64  // Path is rotated once it grows beyond MaxSize bytes
+	MaxBackups int    // rotated files are kept as Path.1 ... Path.MaxBackups
+	TailLines  int    // lines kept per worker
+	MaxCrashes int    // crashed workers whose lines are kept
+}
+
+var defaultOutputPolicy = OutputPolicy{
+	MaxSize:    100 << 20,
+	MaxBackups: 5,
+	TailLines:  100,
+	MaxCrashes: 16,
+}
+
+func (p *OutputPolicy) fill() {
+	if p.MaxSize <= 0 {
+		p.MaxSize = defaultOutputPolicy.MaxSize
+	}
+	if p.MaxBackups <= 0 {
+		p.MaxBackups = defaultOutputPolicy.MaxBackups
+	}
+	if p.TailLines <= 0 {
+		p.TailLines = defaultOutputPolicy.TailLines
+	}
+	if p.MaxCrashes <= 0 {
+		p.MaxCrashes = defaultOutputPolicy.MaxCrashes
+	}
+}
+
+const (
+	maxLineLen   = 64 << 10
+	outputDrain  = time.Second // wait for the pipe of an exited worker
+	outputPrefix = "[pid=%d gen=%d] "
+)
+
+type crashTail struct {
+	Pid   int      `json:"pid"`
+	Slot  int      `json:"slot"`
+	Gen   int      `json:"gen"`
+	Exit  string   `json:"exit"`
+	Time  string   `json:"time"`
+	Lines []string `json:"lines"`
+}
+
+type output struct {
+	policy OutputPolicy
+
+	mu   sync.Mutex // serializes the lines of all workers
+	w    io.Writer
+	file *rotateFile
+
+	workers sync.Map // key: workerPID, value:*workerOutput
+	crashMu sync.Mutex
+	crashes []crashTail // oldest first
+}
+
+func newOutput(p OutputPolicy) *output {
+	o := &output{policy: p, w: os.Stderr}
+	if p.Path != "" {
+		f := &rotateFile{path: p.Path, maxSize: p.MaxSize,
+			maxBackups: p.MaxBackups}
+		if err := f.open(); err != nil {
+			log.Errorf("WorkerOutput\tPath=%s\tErr=%s\n", p.Path, err.Error())
+		} else {
+			o.w, o.file = f, f
+		}
+	}
+	return o
+}
+
+// workerOutput is the tail of one worker.
+type workerOutput struct {
+	pid  int
+	gen  int
+	done chan struct{} // closed on EOF of the pipe
+
+	mu    sync.Mutex
+	lines []string // ring of the last TailLines lines
+	next  int
+}
+
+// capture reads the output of the worker pid from r until EOF.
+func (o *output) capture(pid, gen int, r *os.File) {
+	wo := &workerOutput{pid: pid, gen: gen, done: make(chan struct{})}
+	o.workers.Store(pid, wo)
+	go func() {
+		defer close(wo.done)
+		defer r.Close()
+
+		prefix := fmt.Sprintf(outputPrefix, pid, gen)
+		br := bufio.NewReaderSize(r, maxLineLen)
+		for {
+			// a line longer than maxLineLen is split.
+			line, err := br.ReadSlice('\n')
+			if len(line) > 0 {
+				s := string(line)
+				if line[len(line)-1] == '\n' {
+					s = s[:len(s)-1]
+				}
+				o.write(prefix + s + "\n")
+				wo.add(s, o.policy.TailLines)
+			}
+			if err != nil && err != bufio.ErrBufferFull {
+				return
+			}
+		}
+	}()
+}
+
+func (o *output) write(line string) {
+	o.mu.Lock()
+	io.WriteString(o.w, line)
+	o.mu.Unlock()
+}
+
+func (wo *workerOutput) add(line string, max int) {
+	wo.mu.Lock()
+	if len(wo.lines) < max {
+		wo.lines = append(wo.lines, line)
+	} else {
+		wo.lines[wo.next] = line
+		wo.next = (wo.next + 1) % max
+	}
+	wo.mu.Unlock()
+}
+
+func (wo *workerOutput) tail() []string {
+	wo.mu.Lock()
+	defer wo.mu.Unlock()
+
+	lines := make([]string, 0, len(wo.lines))
+	lines = append(lines, wo.lines[wo.next:]...)
+	return append(lines, wo.lines[:wo.next]...)
+}
+
+// exited forgets the worker pid, and keeps its tail if it crashed.
+func (o *output) exited(pid, slot int, exit string, crashed bool) {
+	v, ok := o.workers.Load(pid)
+	if !ok {
+		return
+	}
+	o.workers.Delete(pid)
+	wo := v.(*workerOutput)
+	// its children may still hold the pipe.
+	select {
+	case <-wo.done:
+	case <-time.After(outputDrain):
+	}
+	if !crashed {
+		return
+	}
+	o.crashMu.Lock()
+	o.crashes = append(o.crashes, crashTail{
+		Pid:   pid,
+		Slot:  slot,
+		Gen:   wo.gen,
+		Exit:  exit,
+		Time:  time.Now().Format(time.RFC3339),
+		Lines: wo.tail(),
+	})
+	if n := len(o.crashes) - o.policy.MaxCrashes; n > 0 {
+		o.crashes = append([]crashTail(nil), o.crashes[n:]...)
+	}
+	o.crashMu.Unlock()
+}
+
+// crashTails returns the crashed workers with their last n lines at most,
+// n <= 0 means all the lines kept.
+func (o *output) crashTails(n int) []crashTail {
+	o.crashMu.Lock()
+	defer o.crashMu.Unlock()
+
+	tails := make([]crashTail, len(o.crashes))
+	for i, t := range o.crashes {
+		if n > 0 && len(t.Lines) > n {
+			t.Lines = t.Lines[len(t.Lines)-n:]
+		}
+		tails[i] = t
+	}
+	return tails
+}
+
+// reopen reopens Path after it was moved away, e.g. by logrotate.
+func (o *output) reopen() {
+	if o.file == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	// the moved file is kept until Path opens again.
+	if err := o.file.open(); err != nil {
+		log.Errorf("WorkerOutput\tPath=%s\tErr=%s\n", o.file.path, err.Error())
+	}
+}
+
+// rotateFile is written under output.mu.
+type rotateFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// open opens Path, the current file is only closed once it has.
+func (f *rotateFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file, f.size = file, fi.Size()
+	return nil
+}
+
+func (f *rotateFile) Write(p []byte) (int, error) {
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		f.rotate()
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts Path.i to Path.i+1, the oldest one is overwritten. If Path
+// can't be opened again, the lines go on to Path.1 until the next rotation.
+func (f *rotateFile) rotate() {
+	for i := f.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i),
+			fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	os.Rename(f.path, f.path+".1")
+	if err := f.open(); err != nil {
+		log.Errorf("WorkerOutput\tPath=%s\tErr=%s\n", f.path, err.Error())
+		f.size = 0
+	}
+}
@@ -0,0 +1,110 @@
+package mw
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readFile(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRotateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.log")
+	f := &rotateFile{path: path, maxSize: 10, maxBackups: 2}
+	if err := f.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.file.Close()
+	for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n",
+		"eeee\n", "ffff\n", "gggg\n"} {
+
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{
+		path:        "gggg\n",
+		path + ".1": "eeee\nffff\n",
+		path + ".2": "cccc\ndddd\n",
+	}
+	for p, s := range want {
+		if got := readFile(t, p); got != s {
+			t.Errorf("%s = %q, want %q", p, got, s)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 kept beyond MaxBackups", path)
+	}
+}
+
+func TestRotateFileOpenFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "out.log")
+	f := &rotateFile{path: path, maxSize: 10, maxBackups: 2}
+	if err := f.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.file.Close()
+	old := f.file
+	f.Write([]byte("aaaaaaaa\n"))
+
+	// Path can't be opened, the lines go on to the old file.
+	os.RemoveAll(dir)
+	for _, line := range []string{"bbbbbbbb\n", "\n"} {
+		if n, err := f.Write([]byte(line)); err != nil || n != len(line) {
+			t.Fatalf("Write(%q) = %d, %v", line, n, err)
+		}
+	}
+	if f.file != old {
+		t.Fatal("the old file was replaced")
+	}
+	// no rotation is retried before another MaxSize bytes.
+	if f.size != 10 {
+		t.Fatalf("size %d, want 10", f.size)
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("dddd\n"))
+	if f.file == old {
+		t.Fatal("Path not opened again")
+	}
+	if got := readFile(t, path); got != "dddd\n" {
+		t.Fatalf("%s = %q", path, got)
+	}
+}
+
+func TestOutputReopenFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "out.log")
+	o := newOutput(OutputPolicy{Path: path, MaxSize: 1 << 20, MaxBackups: 1})
+	if o.file == nil {
+		t.Fatal("Path not opened")
+	}
+	defer o.file.file.Close()
+	moved := filepath.Join(t.TempDir(), "out.log.moved")
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(dir)
+	o.reopen()
+	// the moved file is still written.
+	o.write("line\n")
+	if got := readFile(t, moved); got != "line\n" {
+		t.Fatalf("%s = %q", moved, got)
+	}
+}
@@ -0,0 +1,111 @@
+package mw
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tddhit/tools/log"
+)
+
+// The master holds an exclusive flock on its pid file as long as it runs, so
+// the lock, not the existence of the file, tells whether it is running. A pid
+// file left behind by a killed master is stale and taken over on start.
+
+const (
+	lockRetries  = 5
+	lockInterval = 20 * time.Millisecond
+)
+
+// lockPID locks the pid file at path and writes pid into it. The returned
+// file must be kept open to hold the lock.
+func lockPID(path string, pid int) (*os.File, error) {
+	f, err := openLocked(path)
+	if err != nil {
+		return nil, err
+	}
+	if old, err := readPID(f); err == nil && old != pid {
+		// a master without the lock, e.g. of an older version.
+		if syscall.Kill(old, 0) == nil && isSelf(old) {
+			f.Close()
+			return nil, fmt.Errorf("master %d is running without lock", old)
+		}
+		log.Warnf("StalePID\tPath=%s\tOldPid=%d\n", path, old)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(pid)), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.Sync()
+	return f, nil
+}
+
+func openLocked(path string) (*os.File, error) {
+	for i := 0; ; i++ {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == syscall.EWOULDBLOCK && i < lockRetries {
+			// box-cli ctl may be testing the lock right now.
+			f.Close()
+			time.Sleep(lockInterval)
+			continue
+		}
+		if err == syscall.EWOULDBLOCK {
+			old, _ := readPID(f)
+			f.Close()
+			return nil, fmt.Errorf("master %d is running, %s is locked", old, path)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		// the old master may have removed the file right before we locked it.
+		if sameFile(f, path) {
+			return f, nil
+		}
+		f.Close()
+	}
+}
+
+func sameFile(f *os.File, path string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi, pi)
+}
+
+func readPID(f *os.File) (int, error) {
+	b, err := ioutil.ReadAll(io.NewSectionReader(f, 0, 32))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// runningPID returns the pid written in the pid file at path, without testing
+// the lock. It is only reliable for a master known to hold the lock.
+func runningPID(path string) int {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return pid
+}
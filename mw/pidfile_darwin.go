@@ -0,0 +1,6 @@
+package mw
+
+// isSelf can't tell the binary of another process, the lock alone decides.
+func isSelf(pid int) bool {
+	return false
+}
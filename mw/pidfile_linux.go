@@ -0,0 +1,22 @@
+package mw
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// isSelf reports whether the process pid runs the same binary.
+func isSelf(pid int) bool {
+	exe, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe")
+	if err != nil {
+		return false
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	// the binary may have been replaced for an upgrade.
+	return strings.TrimSuffix(exe, " (deleted)") ==
+		strings.TrimSuffix(self, " (deleted)")
+}
@@ -0,0 +1,37 @@
+package mw
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockPIDOtherBinary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "box.pid")
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	// the pid was reused by a process which is not a master.
+	writePID(t, path, cmd.Process.Pid)
+
+	f, err := lockPID(path, 12345)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestLockPIDWithoutLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "box.pid")
+	// this binary runs as a master which holds no lock.
+	writePID(t, path, os.Getpid())
+
+	if f, err := lockPID(path, os.Getpid()+1); err == nil {
+		f.Close()
+		t.Fatal("took over the pid file of a running master")
+	}
+}
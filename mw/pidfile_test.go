@@ -0,0 +1,64 @@
+package mw
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func writePID(t *testing.T, path string, pid int) {
+	if err := ioutil.WriteFile(path, []byte(strconv.Itoa(pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deadPID returns the pid of a process which has exited.
+func deadPID(t *testing.T) int {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestLockPIDStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "box.pid")
+	writePID(t, path, deadPID(t))
+
+	f, err := lockPID(path, 12345)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if pid := runningPID(path); pid != 12345 {
+		t.Fatalf("pid file holds %d, want 12345", pid)
+	}
+}
+
+func TestLockPIDLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "box.pid")
+	f, err := lockPID(path, 12345)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, err := lockPID(path, 12346); err == nil {
+		g.Close()
+		t.Fatal("locked a pid file locked by another master")
+	}
+	if pid := runningPID(path); pid != 12345 {
+		t.Fatalf("pid file holds %d, want 12345", pid)
+	}
+
+	// the lock goes with the master, the file left behind is taken over.
+	f.Close()
+	g, err := lockPID(path, 12346)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if pid := runningPID(path); pid != 12346 {
+		t.Fatalf("pid file holds %d, want 12346", pid)
+	}
+}
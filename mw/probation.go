@@ -0,0 +1,178 @@
+package mw
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tddhit/tools/log"
+)
+
+// Reloads are staged. The old worker of a slot stays in workerReload, still
+// serving, until the new worker has taken over and then stayed up for the
+// probation period. If the new worker exits before, the old worker is alive
+// again and the reload of the slot fails. A zero probation ends the probation
+// right at takeover.
+//
+// The old workers are retired together once every slot of the reloads in
+// progress passed. If any slot failed, the slots which passed are rolled back
+// to their old workers too, so the workers never run different configs.
+
+const defaultProbation = 5 * time.Second
+
+// reloads tracks the slots of the reloads in progress.
+type reloads struct {
+	sync.Mutex
+	pending  int
+	failed   bool
+	notified bool        // systemd was told RELOADING=1
+	passed   map[int]int // key: new worker pid, value: slot
+	waiters  []chan<- bool
+}
+
+// reloadBegin is called before n slots are reloaded, done gets the result
+// once no reload is in progress any more.
+func (m *master) reloadBegin(n int, done chan<- bool) {
+	m.beginReload(n, done, true)
+}
+
+// recycleBegin is reloadBegin for the recycle of a worker, which is no
+// reload of the service for systemd.
+func (m *master) recycleBegin() {
+	m.beginReload(1, nil, false)
+}
+
+func (m *master) beginReload(n int, done chan<- bool, notify bool) {
+	m.reloads.Lock()
+	m.reloads.pending += n
+	if done != nil {
+		m.reloads.waiters = append(m.reloads.waiters, done)
+	}
+	notify = notify && !m.reloads.notified
+	if notify {
+		m.reloads.notified = true
+	}
+	m.reloads.Unlock()
+	if notify {
+		sdNotify(sdReloading)
+	}
+}
+
+func (m *master) reloading() bool {
+	m.reloads.Lock()
+	defer m.reloads.Unlock()
+
+	return m.reloads.pending > 0
+}
+
+// reloadDone is called once per reloaded slot, ok if the new worker passed
+// its probation.
+func (m *master) reloadDone(ok bool) {
+	m.reloads.Lock()
+	if !ok {
+		m.reloads.failed = true
+	}
+	m.reloads.pending--
+	if m.reloads.pending > 0 {
+		m.reloads.Unlock()
+		return
+	}
+	ok = !m.reloads.failed
+	waiters, passed := m.reloads.waiters, m.reloads.passed
+	notified := m.reloads.notified
+	m.reloads.pending = 0
+	m.reloads.failed = false
+	m.reloads.notified = false
+	m.reloads.passed = nil
+	m.reloads.waiters = nil
+	m.reloads.Unlock()
+
+	for pid, slot := range passed {
+		if ok {
+			m.notifySlot(slot, &message{Typ: msgQuit}, workerReload)
+		} else {
+			m.rollbackSlot(pid, slot)
+		}
+	}
+	if notified {
+		sdNotify(sdReady)
+	}
+	for _, c := range waiters {
+		c <- ok
+	}
+}
+
+// probate retires the old worker of slot once the new worker pid survived
+// the probation period.
+func (m *master) probate(pid, slot int) {
+	if m.probation <= 0 {
+		m.promote(pid, slot)
+		return
+	}
+	m.probationMu.Lock()
+	m.probations.Store(pid, slot)
+	m.probationMu.Unlock()
+	log.Infof("Probation\tPid=%d\tSlot=%d\tPeriod=%s\n", pid, slot, m.probation)
+	time.AfterFunc(m.probation, func() {
+		if _, ok := m.takeProbation(pid); ok {
+			m.promote(pid, slot)
+		}
+	})
+}
+
+// promote holds the old worker of slot until the reloads in progress end,
+// see reloadDone.
+func (m *master) promote(pid, slot int) {
+	m.reloads.Lock()
+	if m.reloads.passed == nil {
+		m.reloads.passed = make(map[int]int)
+	}
+	m.reloads.passed[pid] = slot
+	m.reloads.Unlock()
+	log.Infof("ProbationPass\tPid=%d\tSlot=%d\n", pid, slot)
+	m.reloadDone(true)
+}
+
+// rollbackSlot gives slot back to its old worker and retires the new worker
+// pid, which passed its probation in a failed reload. A new worker which exited
+// since was replaced like a crash, the old one is retired then.
+func (m *master) rollbackSlot(pid, slot int) {
+	if state, ok := m.children.Load(pid); !ok ||
+		state.(workerState) != workerAlive {
+
+		m.notifySlot(slot, &message{Typ: msgQuit}, workerReload)
+		return
+	}
+	old := m.restoreOld(slot)
+	if old == 0 {
+		return
+	}
+	log.Errorf("ReloadRollback\tPid=%d\tSlot=%d\tOldPid=%d\n", pid, slot, old)
+	m.children.Store(pid, workerReload)
+	m.notifySlot(slot, &message{Typ: msgQuit}, workerReload)
+}
+
+// probationFailed gives the slot back to the old worker if the new worker pid
+// exited during its probation.
+func (m *master) probationFailed(pid int) {
+	slot, ok := m.takeProbation(pid)
+	if !ok {
+		return
+	}
+	old := m.restoreOld(slot)
+	log.Errorf("ProbationFail\tPid=%d\tSlot=%d\tOldPid=%d\n", pid, slot, old)
+	m.reloadDone(false)
+}
+
+// takeProbation ends the probation of pid, only one of the timer and the exit
+// of pid gets it.
+func (m *master) takeProbation(pid int) (int, bool) {
+	m.probationMu.Lock()
+	defer m.probationMu.Unlock()
+
+	slot, ok := m.probations.Load(pid)
+	if !ok {
+		return 0, false
+	}
+	m.probations.Delete(pid)
+	return slot.(int), true
+}
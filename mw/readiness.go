@@ -0,0 +1,109 @@
+package mw
+
+import (
+	"context"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tddhit/tools/log"
+)
+
+// A new worker runs the warmup hooks, then polls the readiness check until it
+// passes. Only then it accepts on its listeners, registers its addrs and
+// takes over from the old worker of its slot; until then only the admin
+// server runs, whose /status answers 503. A worker not ready within
+// readinessTimeout exits, and on reload the master keeps the old worker
+// instead.
+
+const (
+	defaultReadinessTimeout = 30 * time.Second
+	readinessInterval       = 200 * time.Millisecond
+)
+
+func (w *worker) waitReady() error {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		w.readinessTimeout)
+	defer cancel()
+
+	for _, f := range w.warmups {
+		if err := f(ctx); err != nil {
+			return err
+		}
+	}
+	if w.readinessCheck != nil {
+		tick := time.NewTicker(readinessInterval)
+		defer tick.Stop()
+		for {
+			err := w.readinessCheck(ctx)
+			if err == nil {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return err
+			case <-tick.C:
+			}
+		}
+	}
+	atomic.StoreInt32(&w.ready, 1)
+	log.Infof("WorkerReady\tPid=%d\tElapsed=%s\n", w.pid, time.Since(start))
+	return nil
+}
+
+func (w *worker) isReady() bool {
+	return atomic.LoadInt32(&w.ready) == 1
+}
+
+// awaitReady keeps the old worker of slot if the new worker pid of a reload
+// does not take over in time.
+func (m *master) awaitReady(pid, slot int) {
+	m.pendingReady.Store(pid, slot)
+	time.AfterFunc(m.readinessTimeout, func() {
+		if m.keepOld(pid) {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	})
+}
+
+// ready is called when pid takes over, it returns false if pid was not forked
+// by a reload.
+func (m *master) ready(pid int) bool {
+	if _, ok := m.pendingReady.Load(pid); !ok {
+		return false
+	}
+	m.pendingReady.Delete(pid)
+	return true
+}
+
+// keepOld gives the slot back to the old worker if the new worker pid has not
+// taken over yet.
+func (m *master) keepOld(pid int) bool {
+	slot, ok := m.pendingReady.Load(pid)
+	if !ok {
+		return false
+	}
+	m.pendingReady.Delete(pid)
+	old := m.restoreOld(slot.(int))
+	log.Errorf("WorkerNotReady\tPid=%d\tSlot=%d\tOldPid=%d\n", pid, slot, old)
+	m.reloadDone(false)
+	return true
+}
+
+// restoreOld makes the old worker of slot, which is retiring, alive and
+// current again. It returns its pid, or 0 if there is none.
+func (m *master) restoreOld(slot int) (old int) {
+	m.children.Range(func(key, value interface{}) bool {
+		s, ok := m.slots.Load(key)
+		if ok && s == slot && value.(workerState) == workerReload {
+			m.children.Store(key, workerAlive)
+			old = key.(int)
+		}
+		return true
+	})
+	if old != 0 {
+		m.current.Store(slot, old)
+	}
+	return
+}
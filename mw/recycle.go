@@ -0,0 +1,218 @@
+package mw
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tddhit/box/stats"
+	"github.com/tddhit/tools/log"
+)
+
+// RecyclePolicy replaces workers which grew too big or too old. The master
+// samples the RSS of every alive worker from /proc and asks it for its
+// goroutines and requests each Interval. A worker past any threshold is
+// replaced like a reload of its slot, one worker at a time, and the recycle
+// is listed in the master stats. A zero threshold is disabled.
+type RecyclePolicy struct {
+	Interval      time.Duration
+	MaxRSS        int64 // bytes
+	MaxGoroutines int
+	MaxLifetime   time.Duration
+	MaxRequests   int64
+}
+
+var defaultRecyclePolicy = RecyclePolicy{
+	Interval: 10 * time.Second,
+}
+
+func (p *RecyclePolicy) fill() {
+	if p.Interval <= 0 {
+		p.Interval = defaultRecyclePolicy.Interval
+	}
+}
+
+func (p *RecyclePolicy) enabled() bool {
+	return p.MaxRSS > 0 || p.MaxGoroutines > 0 || p.MaxLifetime > 0 ||
+		p.MaxRequests > 0
+}
+
+// maxRecycles is the number of recycles kept in the stats.
+const maxRecycles = 32
+
+// usage is sampled from a worker, all but RSS are its reply to msgStats.
+type usage struct {
+	RSS        int64   `json:"rss"`
+	Goroutines int     `json:"goroutines"`
+	Requests   int64   `json:"requests"`
+	QPS        int     `json:"qps"`
+	Inflight   int64   `json:"inflight"`
+	CPU        float64 `json:"cpu"`
+}
+
+type recycleStats struct {
+	Pid    int    `json:"pid"`
+	Slot   int    `json:"slot"`
+	Reason string `json:"reason"`
+	Time   string `json:"time"`
+}
+
+type recycles struct {
+	sync.Mutex
+	total int
+	last  []recycleStats // oldest first
+}
+
+func (r *recycles) add(rs recycleStats) {
+	r.Lock()
+	r.total++
+	r.last = append(r.last, rs)
+	if n := len(r.last) - maxRecycles; n > 0 {
+		r.last = append([]recycleStats(nil), r.last[n:]...)
+	}
+	r.Unlock()
+}
+
+func (r *recycles) stats() (int, []recycleStats) {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.total, append([]recycleStats(nil), r.last...)
+}
+
+func (m *master) watchRecycle() {
+	if !m.recyclePolicy.enabled() {
+		return
+	}
+	tick := time.Tick(m.recyclePolicy.Interval)
+	for range tick {
+		if atomic.LoadInt32(&m.closing) != 0 {
+			return
+		}
+		m.checkRecycle()
+	}
+}
+
+// checkRecycle samples every alive worker, and recycles the first one past a
+// threshold unless a reload is in progress.
+func (m *master) checkRecycle() {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		pid      int
+		slot     int
+		reason   string
+		reloaded bool
+	)
+	m.children.Range(func(key, value interface{}) bool {
+		state := value.(workerState)
+		if state == workerReload {
+			reloaded = true
+		}
+		if state != workerAlive {
+			return true
+		}
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			u := m.sampleUsage(p)
+			m.usages.Store(p, u)
+			if r := m.recycleReason(p, u); r != "" {
+				mu.Lock()
+				if reason == "" {
+					pid, reason = p, r
+				}
+				mu.Unlock()
+			}
+		}(key.(int))
+		return true
+	})
+	wg.Wait()
+	if reason == "" || reloaded || m.reloading() {
+		return
+	}
+	s, ok := m.slots.Load(pid)
+	if !ok {
+		return
+	}
+	slot = s.(int)
+	log.Warnf("WorkerRecycle\tPid=%d\tSlot=%d\tReason=%s\n", pid, slot, reason)
+	m.recycles.add(recycleStats{
+		Pid:    pid,
+		Slot:   slot,
+		Reason: reason,
+		Time:   time.Now().Format(time.RFC3339),
+	})
+	m.recycleBegin()
+	m.forkC <- forkReq{reasonReload, slot}
+}
+
+func (m *master) sampleUsage(pid int) (u usage) {
+	var err error
+	if u.RSS, err = readRSS(pid); err != nil {
+		u.RSS = -1
+	}
+	u.Goroutines, u.Requests = -1, -1
+	conn, ok := m.conns.Load(pid)
+	if !ok {
+		return
+	}
+	msg := &message{Typ: msgStats}
+	rsp, err := conn.(*msgConn).request(msg, m.recyclePolicy.Interval)
+	if err != nil {
+		log.Warnf("SampleUsage\tPid=%d\tErr=%s\n", pid, err.Error())
+		return
+	}
+	rss := u.RSS
+	if err := json.Unmarshal(rsp.Value, &u); err != nil {
+		u.Goroutines, u.Requests = -1, -1
+	}
+	u.RSS = rss
+	return
+}
+
+// recycleReason returns why the worker pid must be recycled, or "".
+func (m *master) recycleReason(pid int, u usage) string {
+	p := m.recyclePolicy
+	switch {
+	case p.MaxRSS > 0 && u.RSS > p.MaxRSS:
+		return fmt.Sprintf("rss %d > %d", u.RSS, p.MaxRSS)
+	case p.MaxGoroutines > 0 && u.Goroutines > p.MaxGoroutines:
+		return fmt.Sprintf("goroutines %d > %d", u.Goroutines, p.MaxGoroutines)
+	case p.MaxRequests > 0 && u.Requests > p.MaxRequests:
+		return fmt.Sprintf("requests %d > %d", u.Requests, p.MaxRequests)
+	}
+	if t, ok := m.started.Load(pid); ok && p.MaxLifetime > 0 {
+		if age := time.Since(t.(time.Time)); age > p.MaxLifetime {
+			return fmt.Sprintf("lifetime %s > %s",
+				age.Truncate(time.Second), p.MaxLifetime)
+		}
+	}
+	return ""
+}
+
+func (w *worker) replyStats(req *message) {
+	rsp := &message{Typ: msgReply}
+	rsp.Value, _ = json.Marshal(w.usage())
+	if err := w.conn.reply(req, rsp); err != nil {
+		log.Errorf("WriteMsg\tPid=%d\tErr=%s\n", w.pid, err.Error())
+	}
+}
+
+// usage returns the usage of the worker but RSS, which the master samples.
+func (w *worker) usage() usage {
+	u := usage{
+		Goroutines: runtime.NumGoroutine(),
+		QPS:        stats.GlobalStats().LastQPS(),
+		CPU:        math.Float64frombits(atomic.LoadUint64(&w.cpu)),
+	}
+	for _, s := range w.servers {
+		u.Requests += s.Requests()
+		u.Inflight += s.Inflight()
+	}
+	return u
+}
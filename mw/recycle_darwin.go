@@ -0,0 +1,7 @@
+package mw
+
+import "errors"
+
+func readRSS(pid int) (int64, error) {
+	return 0, errors.New("rss is not supported")
+}
@@ -0,0 +1,44 @@
+package mw
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var errNoRSS = errors.New("no VmRSS")
+
+// readRSS returns VmRSS of /proc/<pid>/status in bytes.
+func readRSS(pid int) (int64, error) {
+	f, err := os.Open("/proc/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return parseRSS(f)
+}
+
+// parseRSS returns VmRSS of a /proc/<pid>/status file in bytes.
+func parseRSS(r io.Reader) (int64, error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, "VmRSS:") {
+			continue
+		}
+		// VmRSS:	   12345 kB
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return 0, errNoRSS
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb << 10, nil
+	}
+	return 0, errNoRSS
+}
@@ -0,0 +1,39 @@
+package mw
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseRSS(t *testing.T) {
+	tests := []struct {
+		status string
+		want   int64
+		err    bool
+	}{
+		{"Name:\tbox\nVmPeak:\t  20000 kB\nVmRSS:\t   12345 kB\nThreads:\t8\n",
+			12345 << 10, false},
+		{"VmRSS:\t0 kB\n", 0, false},
+		// kernel threads have no VmRSS.
+		{"Name:\tkthreadd\nThreads:\t1\n", 0, true},
+		{"VmRSS:\n", 0, true},
+		{"VmRSS:\tmany kB\n", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRSS(strings.NewReader(tt.status))
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("parseRSS(%q) = %d, %v, want %d, err %v",
+				tt.status, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestReadRSS(t *testing.T) {
+	if rss, err := readRSS(os.Getpid()); err != nil || rss <= 0 {
+		t.Fatalf("readRSS(self) = %d, %v", rss, err)
+	}
+	if _, err := readRSS(-1); err == nil {
+		t.Fatal("readRSS(-1) has no error")
+	}
+}
@@ -0,0 +1,79 @@
+package mw
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRecycleReason(t *testing.T) {
+	m := &master{recyclePolicy: RecyclePolicy{
+		MaxRSS:        100 << 20,
+		MaxGoroutines: 1000,
+		MaxLifetime:   time.Hour,
+		MaxRequests:   10000,
+	}}
+	m.started.Store(1, time.Now())
+	m.started.Store(2, time.Now().Add(-2*time.Hour))
+	tests := []struct {
+		pid  int
+		u    usage
+		want string
+	}{
+		{1, usage{RSS: 10 << 20, Goroutines: 10, Requests: 10}, ""},
+		{1, usage{RSS: 200 << 20}, "rss 209715200 > 104857600"},
+		{1, usage{Goroutines: 1001}, "goroutines 1001 > 1000"},
+		{1, usage{Requests: 10001}, "requests 10001 > 10000"},
+		{2, usage{}, "lifetime 2h0m0s > 1h0m0s"},
+		// unknown usage is -1, never past a threshold.
+		{1, usage{RSS: -1, Goroutines: -1, Requests: -1}, ""},
+		{3, usage{}, ""},
+	}
+	for _, tt := range tests {
+		if got := m.recycleReason(tt.pid, tt.u); got != tt.want {
+			t.Errorf("recycleReason(%d, %+v) = %q, want %q",
+				tt.pid, tt.u, got, tt.want)
+		}
+	}
+
+	m.recyclePolicy = RecyclePolicy{}
+	if got := m.recycleReason(2, usage{RSS: 1 << 40}); got != "" {
+		t.Errorf("disabled policy recycles: %q", got)
+	}
+}
+
+func TestRecyclesAdd(t *testing.T) {
+	var r recycles
+	for i := 0; i < maxRecycles+5; i++ {
+		r.add(recycleStats{Pid: i})
+	}
+	total, last := r.stats()
+	if total != maxRecycles+5 {
+		t.Errorf("total = %d, want %d", total, maxRecycles+5)
+	}
+	if len(last) != maxRecycles {
+		t.Fatalf("kept %d, want %d", len(last), maxRecycles)
+	}
+	for i, rs := range last {
+		if rs.Pid != i+5 {
+			t.Fatalf("last[%d].Pid = %d, want %d, the oldest are dropped",
+				i, rs.Pid, i+5)
+		}
+	}
+	// stats returns a copy.
+	last[0].Pid = -1
+	if _, again := r.stats(); again[0].Pid != 5 {
+		t.Error("stats shares its slice")
+	}
+}
+
+func TestRecyclesAddFew(t *testing.T) {
+	var r recycles
+	for i := 0; i < 3; i++ {
+		r.add(recycleStats{Pid: i, Reason: strconv.Itoa(i)})
+	}
+	total, last := r.stats()
+	if total != 3 || len(last) != 3 || last[0].Pid != 0 || last[2].Pid != 2 {
+		t.Fatalf("stats() = %d, %+v", total, last)
+	}
+}
@@ -0,0 +1,159 @@
+package mw
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RestartPolicy controls how the master restarts crashed workers.
+// The delay before restarting a slot grows exponentially from MinBackoff
+// to MaxBackoff, and is reset once a worker has lived longer than
+// MaxBackoff. When more than MaxRestarts crashes happen within Window the
+// master gives up the slot and calls OnGiveUp.
+type RestartPolicy struct {
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	Jitter      float64 // 0.2 means ±20% of the backoff, 0 disables it
+	MaxRestarts int     // 0 means never give up
+	Window      time.Duration
+	OnGiveUp    func(slot, restarts int, lastExit string)
+}
+
+var defaultRestartPolicy = RestartPolicy{
+	MinBackoff:  time.Second,
+	MaxBackoff:  time.Minute,
+	Jitter:      0.2,
+	MaxRestarts: 10,
+	Window:      5 * time.Minute,
+}
+
+func (p *RestartPolicy) fill() {
+	if p.MinBackoff <= 0 {
+		p.MinBackoff = defaultRestartPolicy.MinBackoff
+	}
+	if p.MaxBackoff < p.MinBackoff {
+		p.MaxBackoff = p.MinBackoff
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		p.Jitter = defaultRestartPolicy.Jitter
+	}
+	if p.Window <= 0 {
+		p.Window = defaultRestartPolicy.Window
+	}
+}
+
+// slotState tracks the crashes of the workers of one slot.
+type slotState struct {
+	sync.Mutex
+	restarts int
+	attempt  int         // consecutive crashes, drives the backoff
+	crashes  []time.Time // crashes within the policy window
+	backoff  time.Duration
+	nextFork time.Time
+	gaveUp   bool
+	lastExit string
+	started  time.Time
+	stops    int // bumped by stop, cancels the pending restart
+}
+
+func (s *slotState) start() {
+	s.Lock()
+	s.started = time.Now()
+	s.nextFork = time.Time{}
+	s.Unlock()
+}
+
+// reset gives the slot a fresh start, e.g. on reload.
+func (s *slotState) reset() {
+	s.Lock()
+	s.attempt = 0
+	s.crashes = nil
+	s.backoff = 0
+	s.gaveUp = false
+	s.Unlock()
+}
+
+// crash records a crash of the current worker of the slot and returns the
+// delay before restarting it, or giveUp.
+func (s *slotState) crash(p *RestartPolicy) (delay time.Duration, giveUp bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	if !s.started.IsZero() && now.Sub(s.started) > p.MaxBackoff {
+		s.attempt = 0
+	}
+	crashes := s.crashes[:0]
+	for _, t := range s.crashes {
+		if now.Sub(t) < p.Window {
+			crashes = append(crashes, t)
+		}
+	}
+	s.crashes = append(crashes, now)
+	if p.MaxRestarts > 0 && len(s.crashes) > p.MaxRestarts {
+		s.gaveUp = true
+		s.backoff = 0
+		return 0, true
+	}
+	delay = p.MinBackoff << uint(s.attempt)
+	if delay > p.MaxBackoff || delay <= 0 {
+		delay = p.MaxBackoff
+	} else {
+		s.attempt++
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * p.Jitter *
+			float64(delay))
+	}
+	s.restarts++
+	s.backoff = delay
+	s.nextFork = now.Add(delay)
+	return delay, false
+}
+
+// fill copies the restart state of the slot into ws.
+func (s *slotState) fill(ws *workerStats) {
+	s.Lock()
+	defer s.Unlock()
+
+	ws.Restarts = s.restarts
+	ws.LastExit = s.lastExit
+	if s.gaveUp {
+		ws.Backoff = "gaveup"
+	} else if wait := time.Until(s.nextFork); wait > 0 {
+		ws.Backoff = wait.String()
+	}
+}
+
+// stop gives the slot up without waiting for the policy.
+func (s *slotState) stop() {
+	s.Lock()
+	s.gaveUp = true
+	s.backoff = 0
+	s.nextFork = time.Time{}
+	s.stops++
+	s.Unlock()
+}
+
+// generation returns the number of stops of the slot, a restart scheduled
+// before a stop compares it to drop itself.
+func (s *slotState) generation() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.stops
+}
+
+func (s *slotState) waiting() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.gaveUp || time.Until(s.nextFork) > 0
+}
+
+func (s *slotState) exit(status string) {
+	s.Lock()
+	s.lastExit = status
+	s.Unlock()
+}
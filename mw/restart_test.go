@@ -0,0 +1,103 @@
+package mw
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRestartAfterScaleDown(t *testing.T) {
+	p := RestartPolicy{MinBackoff: 20 * time.Millisecond}
+	p.fill()
+	m := &master{
+		workerNum:     3,
+		restartPolicy: p,
+		forkC:         make(chan forkReq, 4),
+	}
+	m.restart(1, reasonCrash)
+	m.restart(2, reasonCrash)
+	// slot 2 goes away while backing off, slot 1 goes away and comes back.
+	m.scaleDown(3, 1)
+	m.scaleUp(1, 2)
+	if req := <-m.forkC; req != (forkReq{reasonScale, 1}) {
+		t.Fatalf("got %+v, want the fork of scaleUp", req)
+	}
+	select {
+	case req := <-m.forkC:
+		t.Fatalf("restarted %+v after its slot was scaled down", req)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRestartBackoff(t *testing.T) {
+	p := RestartPolicy{MinBackoff: 10 * time.Millisecond, MaxRestarts: 2}
+	p.fill()
+	m := &master{
+		workerNum:     1,
+		restartPolicy: p,
+		forkC:         make(chan forkReq, 4),
+	}
+	for i := 0; i < 2; i++ {
+		m.restart(0, reasonCrash)
+		select {
+		case req := <-m.forkC:
+			if req != (forkReq{reasonCrash, 0}) {
+				t.Fatalf("got %+v", req)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("not restarted")
+		}
+	}
+	m.restart(0, reasonCrash)
+	if !m.slotState(0).waiting() {
+		t.Fatal("slot not given up after MaxRestarts")
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	gaveUp := make(chan int, 2)
+	p := RestartPolicy{
+		MinBackoff:  time.Hour,
+		MaxRestarts: 1,
+		OnGiveUp: func(slot, restarts int, lastExit string) {
+			gaveUp <- slot
+		},
+	}
+	p.fill()
+	m := &master{
+		workerNum:     2,
+		restartPolicy: p,
+		forkC:         make(chan forkReq, 4),
+		hooks: &hooks{
+			timeout: time.Second,
+			workerCrash: []Hook{func(ctx context.Context, e Event) error {
+				if e.Slot == 1 {
+					return errors.New("no more")
+				}
+				return nil
+			}},
+		},
+	}
+	// slot 0 runs out of restarts, the hook gives slot 1 up at once.
+	m.crashed(100, 0, reasonCrash)
+	m.crashed(101, 0, reasonCrash)
+	m.crashed(102, 1, reasonCrash)
+	for _, want := range []int{0, 1} {
+		if !m.slotState(want).waiting() {
+			t.Fatalf("slot %d not given up", want)
+		}
+	}
+	got := map[int]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case slot := <-gaveUp:
+			got[slot] = true
+		case <-time.After(time.Second):
+			t.Fatalf("OnGiveUp called for %v, want slots 0 and 1", got)
+		}
+	}
+	if !got[0] || !got[1] {
+		t.Fatalf("OnGiveUp called for %v, want slots 0 and 1", got)
+	}
+}
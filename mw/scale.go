@@ -0,0 +1,190 @@
+package mw
+
+import (
+	"math"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tddhit/tools/log"
+)
+
+// ScalePolicy sizes the pool of workers between Min and Max. Each Interval
+// the master averages the QPS, in-flight requests and CPU reported by the
+// workers, and compares them with the targets per worker. The pool grows to
+// match the busiest metric at once, and shrinks by one worker at a time, each
+// after its cooldown since the last change. A removed worker quits
+// gracefully like on reload. A zero target is disabled.
+type ScalePolicy struct {
+	Min int
+	Max int
+
+	TargetQPS      int
+	TargetInflight int64
+	TargetCPU      float64 // CPUs, e.g. 0.7
+
+	Interval     time.Duration
+	Tolerance    float64 // 0.1 means the load may be ±10% off target
+	UpCooldown   time.Duration
+	DownCooldown time.Duration
+}
+
+var defaultScalePolicy = ScalePolicy{
+	Interval:     5 * time.Second,
+	Tolerance:    0.1,
+	UpCooldown:   30 * time.Second,
+	DownCooldown: 5 * time.Minute,
+}
+
+func (p *ScalePolicy) fill() {
+	if p.Min <= 0 {
+		p.Min = 1
+	}
+	if p.Max < p.Min {
+		p.Max = p.Min
+	}
+	if p.Interval <= 0 {
+		p.Interval = defaultScalePolicy.Interval
+	}
+	if p.Tolerance <= 0 || p.Tolerance >= 1 {
+		p.Tolerance = defaultScalePolicy.Tolerance
+	}
+	if p.UpCooldown <= 0 {
+		p.UpCooldown = defaultScalePolicy.UpCooldown
+	}
+	if p.DownCooldown <= 0 {
+		p.DownCooldown = defaultScalePolicy.DownCooldown
+	}
+}
+
+func (p *ScalePolicy) enabled() bool {
+	return p.Max > p.Min &&
+		(p.TargetQPS > 0 || p.TargetInflight > 0 || p.TargetCPU > 0)
+}
+
+// clamp returns n within [Min, Max].
+func (p *ScalePolicy) clamp(n int) int {
+	if n < p.Min {
+		return p.Min
+	}
+	if n > p.Max {
+		return p.Max
+	}
+	return n
+}
+
+func (m *master) numWorkers() int {
+	return int(atomic.LoadInt32(&m.workerNum))
+}
+
+func (m *master) watchScale() {
+	if !m.scalePolicy.enabled() {
+		return
+	}
+	last := time.Now()
+	tick := time.Tick(m.scalePolicy.Interval)
+	for range tick {
+		if atomic.LoadInt32(&m.closing) != 0 {
+			return
+		}
+		if m.checkScale(last) {
+			last = time.Now()
+		}
+	}
+}
+
+// checkScale resizes the pool if the load is off target, it returns true if
+// it did.
+func (m *master) checkScale(last time.Time) bool {
+	p := m.scalePolicy
+	if m.reloading() || atomic.LoadInt32(&m.upgrading) == 1 {
+		return false
+	}
+	var (
+		n     int
+		load  usage
+		retry bool
+	)
+	m.children.Range(func(key, value interface{}) bool {
+		switch value.(workerState) {
+		case workerReload:
+			retry = true
+		case workerAlive:
+			u := m.sampleUsage(key.(int))
+			m.usages.Store(key, u)
+			if u.Goroutines < 0 {
+				// no reply, the worker is starting or stuck.
+				return true
+			}
+			n++
+			load.QPS += u.QPS
+			load.Inflight += u.Inflight
+			load.CPU += u.CPU
+		}
+		return true
+	})
+	if retry || n == 0 {
+		return false
+	}
+	ratio := 0.0
+	if p.TargetQPS > 0 {
+		ratio = math.Max(ratio, float64(load.QPS)/float64(n*p.TargetQPS))
+	}
+	if p.TargetInflight > 0 {
+		ratio = math.Max(ratio,
+			float64(load.Inflight)/float64(int64(n)*p.TargetInflight))
+	}
+	if p.TargetCPU > 0 {
+		ratio = math.Max(ratio, load.CPU/(float64(n)*p.TargetCPU))
+	}
+	cur := m.numWorkers()
+	to := cur
+	switch {
+	case ratio > 1+p.Tolerance && time.Since(last) >= p.UpCooldown:
+		to = p.clamp(int(math.Ceil(float64(cur) * ratio)))
+	case ratio < 1-p.Tolerance && time.Since(last) >= p.DownCooldown:
+		if int(math.Ceil(float64(cur)*ratio)) < cur {
+			to = p.clamp(cur - 1)
+		}
+	}
+	if to == cur {
+		return false
+	}
+	log.Infof("Scale\tPid=%d\tFrom=%d\tTo=%d\tRatio=%.2f\n", m.pid, cur, to, ratio)
+	if to > cur {
+		m.scaleUp(cur, to)
+	} else {
+		m.scaleDown(cur, to)
+	}
+	return true
+}
+
+// scaleUp forks the workers of the slots [from, to).
+func (m *master) scaleUp(from, to int) {
+	atomic.StoreInt32(&m.workerNum, int32(to))
+	for slot := from; slot < to; slot++ {
+		m.slotState(slot).reset()
+		m.forkC <- forkReq{reasonScale, slot}
+	}
+}
+
+// scaleDown retires the workers of the slots [to, from), which are not
+// restarted any more.
+func (m *master) scaleDown(from, to int) {
+	atomic.StoreInt32(&m.workerNum, int32(to))
+	for slot := to; slot < from; slot++ {
+		m.current.Delete(slot)
+		m.readySlots.Delete(slot)
+		m.slotState(slot).stop()
+		m.notifySlot(slot, &message{Typ: msgQuit}, workerAlive)
+	}
+}
+
+// cpuTime returns the user and system CPU time of the process.
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
@@ -0,0 +1,114 @@
+package mw
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tddhit/box/socket"
+	"github.com/tddhit/box/transport"
+	"github.com/tddhit/tools/log"
+)
+
+// Graceful shutdown of a worker is bounded by shutdownTimeout:
+//
+//  1. deregister: remove the addrs from the registry, for at most
+//     1/deregisterShare of the timeout.
+//  2. drain: stop accepting and wait for the in-flight requests until the
+//     rest of the timeout is over.
+//  3. force: close the connections left once the deadline is reached.
+//
+// The master kills a worker which is still running shutdownKillGrace after
+// the deadline.
+
+const (
+	defaultShutdownTimeout = 30 * time.Second
+	shutdownKillGrace      = 2 * time.Second
+	deregisterShare        = 2
+)
+
+func (w *worker) close() {
+	if !atomic.CompareAndSwapInt32(&w.closing, 0, 1) {
+		return
+	}
+	w.closeWG.Add(1)
+	defer w.closeWG.Done()
+	if w.conn == nil {
+		sdNotify(sdStopping)
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), w.shutdownTimeout)
+	defer cancel()
+
+	// the deregistration waits for the registry TTL, which must not eat the
+	// budget of the drain.
+	budget := w.shutdownTimeout / deregisterShare
+	log.Infof("Shutdown\tPid=%d\tPhase=deregister\tServers=%d\tBudget=%s\n",
+		w.pid, len(w.servers), budget)
+	dctx, dcancel := context.WithTimeout(ctx, budget)
+	w.eachServer(func(s *transport.Server) {
+		s.UnregisterAddrContext(dctx)
+	})
+	dcancel()
+
+	var inflight int64
+	for _, s := range w.servers {
+		inflight += s.Inflight()
+	}
+	log.Infof("Shutdown\tPid=%d\tPhase=drain\tInflight=%d\tElapsed=%s\tBudget=%s\n",
+		w.pid, inflight, time.Since(start), w.shutdownTimeout-time.Since(start))
+	var abandoned int64
+	w.eachServer(func(s *transport.Server) {
+		if err := s.Shutdown(ctx); err != nil {
+			n := s.Inflight()
+			atomic.AddInt64(&abandoned, n)
+			log.Warnf("Shutdown\tPid=%d\tPhase=force\tAddr=%s\tAbandoned=%d\n",
+				w.pid, s.Addr(), n)
+		}
+	})
+	w.hooks.run("OnShutdown", w.hooks.shutdown, w.event(reasonShutdown))
+	if w.conn == nil {
+		// single process, free the ports for the next run.
+		w.admin.Close()
+		w.master.Close()
+		socket.Release()
+		socket.RemoveUnix()
+	}
+	log.Infof("Shutdown\tPid=%d\tPhase=done\tAbandoned=%d\tElapsed=%s\n",
+		w.pid, abandoned, time.Since(start))
+}
+
+// eachServer calls f for every server concurrently and waits for them.
+func (w *worker) eachServer(f func(s *transport.Server)) {
+	var wg sync.WaitGroup
+	for _, s := range w.servers {
+		wg.Add(1)
+		go func(s *transport.Server) {
+			f(s)
+			wg.Done()
+		}(s)
+	}
+	wg.Wait()
+}
+
+// killAfter kills the worker if it is still running after the shutdown
+// deadline.
+func (m *master) killAfter(pid int) {
+	forked, _ := m.started.Load(pid)
+	time.AfterFunc(m.shutdownTimeout+shutdownKillGrace, func() {
+		state, ok := m.children.Load(pid)
+		// the pid may have been reused by a new worker meanwhile.
+		if t, _ := m.started.Load(pid); !ok || t != forked {
+			return
+		}
+		switch state.(workerState) {
+		case workerQuit, workerCrash:
+			return
+		}
+		log.Errorf("ShutdownKill\tPid=%d\tTimeout=%s\n", pid, m.shutdownTimeout)
+		syscall.Kill(pid, syscall.SIGKILL)
+	})
+}
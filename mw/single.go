@@ -0,0 +1,96 @@
+package mw
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/tddhit/box/socket"
+	"github.com/tddhit/tools/log"
+)
+
+// In single-process mode the process serves the /stats and /ctl endpoints of
+// the master on masterAddr too, as the master of itself, so box-cli ctl and
+// the stats scrapers work the same. There is no other worker to reload or
+// restart, those requests are answered 501.
+
+const unsupportedMsg = "not supported in single-process mode"
+
+func (w *worker) serveMaster() {
+	if w.masterAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", w.doMasterStats)
+	mux.HandleFunc("/ctl/workers", w.ctl("GET", w.doCtlWorkers))
+	mux.HandleFunc("/ctl/reload", w.ctl("POST", w.doCtlUnsupported))
+	mux.HandleFunc("/ctl/restart", w.ctl("POST", w.doCtlUnsupported))
+	mux.HandleFunc("/ctl/stop", w.ctl("POST", w.doCtlStop))
+	mux.HandleFunc("/ctl/reopen", w.ctl("POST", w.doCtlReopen))
+	mux.HandleFunc("/ctl/crashes", w.ctl("GET", w.doCtlCrashes))
+	lis, err := socket.Listen(w.masterAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.master.Handler = mux
+	if err := w.master.Serve(lis); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+func (w *worker) ctl(method string,
+	h func(*http.Request) *ctlRsp) http.HandlerFunc {
+
+	return ctlHandler(w.pid, w.ctlToken, method, h)
+}
+
+// stats returns the process as the alive worker of slot 0.
+func (w *worker) stats() workerStats {
+	u := w.usage()
+	ws := workerStats{
+		Pid:        w.pid,
+		State:      workerAlive.String(),
+		Uptime:     time.Since(w.started).Truncate(time.Second).String(),
+		Goroutines: u.Goroutines,
+		Requests:   u.Requests,
+		QPS:        u.QPS,
+		Inflight:   u.Inflight,
+		CPU:        u.CPU,
+	}
+	if rss, err := readRSS(w.pid); err == nil {
+		ws.RSS = rss
+	}
+	return ws
+}
+
+func (w *worker) doMasterStats(rsp http.ResponseWriter, req *http.Request) {
+	out, _ := json.Marshal(masterStats{
+		Worker:    map[string]int{reasonStart: 1},
+		Workers:   []workerStats{w.stats()},
+		WorkerNum: 1,
+	})
+	rsp.Write(out)
+}
+
+func (w *worker) doCtlWorkers(req *http.Request) *ctlRsp {
+	return &ctlRsp{Code: http.StatusOK, Workers: []workerStats{w.stats()}}
+}
+
+func (w *worker) doCtlUnsupported(req *http.Request) *ctlRsp {
+	return &ctlRsp{Code: http.StatusNotImplemented, Msg: unsupportedMsg}
+}
+
+func (w *worker) doCtlStop(req *http.Request) *ctlRsp {
+	// let the response out before draining.
+	time.AfterFunc(100*time.Millisecond, w.close)
+	return &ctlRsp{Code: http.StatusOK, Msg: "stopping"}
+}
+
+func (w *worker) doCtlReopen(req *http.Request) *ctlRsp {
+	log.Reopen()
+	return &ctlRsp{Code: http.StatusOK, Msg: "reopened"}
+}
+
+func (w *worker) doCtlCrashes(req *http.Request) *ctlRsp {
+	return &ctlRsp{Code: http.StatusOK, Crashes: []crashTail{}}
+}
@@ -0,0 +1,171 @@
+package mw
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+
+	"github.com/tddhit/box/transport"
+	tropt "github.com/tddhit/box/transport/option"
+)
+
+func freePort(t *testing.T) int {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().(*net.TCPAddr).Port
+}
+
+func get(t *testing.T, url string) (int, []byte) {
+	rsp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	b, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsp.StatusCode, b
+}
+
+func TestWithoutFork(t *testing.T) {
+	var ports []string
+	for i := 0; i < 3; i++ {
+		ports = append(ports, "127.0.0.1:"+strconv.Itoa(freePort(t)))
+	}
+	gw := runtime.NewServeMux()
+	pattern := runtime.MustPattern(runtime.NewPattern(1, []int{2, 0},
+		[]string{"ping"}, ""))
+	gw.Handle("GET", pattern, func(w http.ResponseWriter, r *http.Request,
+		_ map[string]string) {
+
+		fmt.Fprint(w, "pong")
+	})
+	s, err := transport.Listen("http://"+ports[0], tropt.WithGatewayMux(gw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := New(WithoutFork(), WithServer(s), WithWorkerAddr(ports[1]),
+		WithMasterAddr(ports[2]),
+		WithPIDPath(filepath.Join(t.TempDir(), "nofork.pid")),
+		WithShutdownTimeout(time.Second))
+	if !IsWorker() {
+		t.Fatal("IsWorker is false without fork")
+	}
+	done := make(chan struct{})
+	go func() {
+		f.Go()
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rsp, err := http.Get("http://" + ports[0] + "/ping")
+		if err == nil {
+			b, _ := ioutil.ReadAll(rsp.Body)
+			rsp.Body.Close()
+			if string(b) != "pong" {
+				t.Fatalf("ping: %q", b)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if code, b := get(t, "http://"+ports[1]+"/status"); code != http.StatusOK {
+		t.Fatalf("worker /status: %d %s", code, b)
+	}
+	code, b := get(t, "http://"+ports[2]+"/stats")
+	var stats masterStats
+	if err := json.Unmarshal(b, &stats); err != nil || code != http.StatusOK {
+		t.Fatalf("master /stats: %d %s", code, b)
+	}
+	if len(stats.Workers) != 1 || stats.Workers[0].Requests < 1 {
+		t.Fatalf("master /stats: %s", b)
+	}
+	code, b = get(t, "http://"+ports[2]+"/ctl/workers")
+	var ctl ctlRsp
+	if err := json.Unmarshal(b, &ctl); err != nil || code != http.StatusOK ||
+		len(ctl.Workers) != 1 {
+
+		t.Fatalf("/ctl/workers: %d %s", code, b)
+	}
+	rsp, err := http.Post("http://"+ports[2]+"/ctl/reload", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("/ctl/reload: %d", rsp.StatusCode)
+	}
+
+	f.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Go did not return after Stop")
+	}
+	for _, addr := range ports {
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("%s is not free after shutdown: %s", addr, err)
+		}
+		lis.Close()
+	}
+}
+
+func TestRequestWithoutFork(t *testing.T) {
+	f := New(WithoutFork(),
+		WithPIDPath(filepath.Join(t.TempDir(), "nofork.pid")))
+	HandleMsg("echo", func(value []byte) ([]byte, error) {
+		return append([]byte("echo "), value...), nil
+	})
+	HandleMsg("fail", func(value []byte) ([]byte, error) {
+		return nil, errors.New("failed")
+	})
+	block := make(chan struct{})
+	defer close(block)
+	HandleMsg("block", func(value []byte) ([]byte, error) {
+		<-block
+		return nil, nil
+	})
+	defer func() {
+		for _, name := range []string{"echo", "fail", "block"} {
+			handlers.Delete(name)
+		}
+	}()
+
+	// the process answers itself, there is no master to ask.
+	if b, err := f.Request("echo", []byte("hi"), time.Second); err != nil ||
+		string(b) != "echo hi" {
+
+		t.Fatalf("echo: %q, %v", b, err)
+	}
+	if _, err := f.Request("fail", nil, time.Second); err == nil ||
+		err.Error() != "failed" {
+
+		t.Fatalf("fail: %v", err)
+	}
+	if _, err := f.Request("none", nil, time.Second); err == nil {
+		t.Fatal("no error without a handler")
+	}
+	_, err := f.Request("block", nil, 50*time.Millisecond)
+	if err != errMsgTimeout {
+		t.Fatalf("block: %v, want %v", err, errMsgTimeout)
+	}
+}
@@ -0,0 +1,92 @@
+package mw
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/tddhit/tools/log"
+)
+
+// systemd notifications, see sd_notify(3). The master reports READY=1 once a
+// worker of every slot is ready, RELOADING=1 until the workers of a reload
+// took over or were given up, and STOPPING=1 on shutdown. After an upgrade
+// the new master reports itself as MAINPID, which needs NotifyAccess=all in
+// the unit file. Without NOTIFY_SOCKET all of them are no-ops.
+
+const (
+	sdReady     = "READY=1"
+	sdReloading = "RELOADING=1"
+	sdStopping  = "STOPPING=1"
+	sdWatchdog  = "WATCHDOG=1"
+)
+
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// a leading '@' is an abstract socket, which net handles by itself.
+	conn, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		log.Warnf("SdNotify\tPid=%d\tState=%s\tErr=%s\n",
+			os.Getpid(), state, err.Error())
+		return err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		log.Warnf("SdNotify\tPid=%d\tState=%s\tErr=%s\n",
+			os.Getpid(), state, err.Error())
+		return err
+	}
+	return nil
+}
+
+// watchdogInterval returns half of WATCHDOG_USEC, or 0 if the watchdog is
+// disabled or meant for another process. An upgraded master takes over the
+// watchdog of the old one.
+func watchdogInterval(upgraded bool) time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) && !upgraded {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// watchdog pings systemd until closing is set.
+func watchdog(interval time.Duration, closing *int32) {
+	if interval <= 0 {
+		return
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for range tick.C {
+		if atomic.LoadInt32(closing) == 1 {
+			return
+		}
+		sdNotify(sdWatchdog)
+	}
+}
+
+// workerReady is called when the worker pid of slot is ready. The first time
+// every slot has a ready worker, the master is ready.
+func (m *master) workerReady(pid, slot int) {
+	m.readySlots.Store(slot, pid)
+	n := 0
+	m.readySlots.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	if n < m.numWorkers() || !atomic.CompareAndSwapInt32(&m.notified, 0, 1) {
+		return
+	}
+	sdNotify(sdReady + "\nMAINPID=" + strconv.Itoa(m.pid))
+	log.Infof("MasterReady\tPid=%d\tWorkerNum=%d\n", m.pid, m.numWorkers())
+}
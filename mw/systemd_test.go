@@ -0,0 +1,139 @@
+package mw
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listenNotify binds a fake systemd notify socket and points NOTIFY_SOCKET
+// to it.
+func listenNotify(t *testing.T) *net.UnixConn {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram",
+		&net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// readNotify returns the next state sent, or "" if none within timeout.
+func readNotify(t *testing.T, conn *net.UnixConn, timeout time.Duration) string {
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(buf)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return ""
+		}
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	conn := listenNotify(t)
+	for _, state := range []string{sdReady, sdReloading, sdStopping, sdWatchdog} {
+		if err := sdNotify(state); err != nil {
+			t.Fatal(err)
+		}
+		if got := readNotify(t, conn, time.Second); got != state {
+			t.Errorf("sdNotify(%q) sent %q", state, got)
+		}
+	}
+}
+
+func TestSdNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify(sdReady); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSdNotifyMainPID(t *testing.T) {
+	conn := listenNotify(t)
+	m := &master{pid: 4242, workerNum: 2}
+	m.workerReady(100, 0)
+	if got := readNotify(t, conn, 100*time.Millisecond); got != "" {
+		t.Fatalf("ready before every slot: %q", got)
+	}
+	m.workerReady(101, 1)
+	want := sdReady + "\nMAINPID=4242"
+	if got := readNotify(t, conn, time.Second); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	// a restarted worker does not make the master ready again.
+	m.workerReady(102, 1)
+	if got := readNotify(t, conn, 100*time.Millisecond); got != "" {
+		t.Fatalf("ready twice: %q", got)
+	}
+}
+
+func TestSdNotifyReload(t *testing.T) {
+	conn := listenNotify(t)
+	m := &master{}
+	// a reload of two slots and a restart of one overlapping it.
+	m.reloadBegin(2, nil)
+	m.reloadBegin(1, nil)
+	if got := readNotify(t, conn, time.Second); got != sdReloading {
+		t.Fatalf("got %q, want %q", got, sdReloading)
+	}
+	if got := readNotify(t, conn, 100*time.Millisecond); got != "" {
+		t.Fatalf("RELOADING=1 twice: %q", got)
+	}
+	m.reloadDone(true)
+	m.reloadDone(false)
+	if got := readNotify(t, conn, 100*time.Millisecond); got != "" {
+		t.Fatalf("ready with a slot pending: %q", got)
+	}
+	m.reloadDone(true)
+	if got := readNotify(t, conn, time.Second); got != sdReady {
+		t.Fatalf("got %q, want %q", got, sdReady)
+	}
+	if m.reloading() {
+		t.Fatal("still reloading")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		usec, pid string
+		upgraded  bool
+		want      time.Duration
+	}{
+		{"", "", false, 0},
+		{"2000000", "", false, time.Second},
+		{"2000000", pid, false, time.Second},
+		{"2000000", "1", false, 0},
+		{"2000000", "1", true, time.Second},
+		{"-1", "", false, 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("WATCHDOG_USEC", tt.usec)
+		t.Setenv("WATCHDOG_PID", tt.pid)
+		if got := watchdogInterval(tt.upgraded); got != tt.want {
+			t.Errorf("watchdogInterval(%s, %s, %v) = %s, want %s",
+				tt.usec, tt.pid, tt.upgraded, got, tt.want)
+		}
+	}
+}
+
+func TestSdNotifyRecycle(t *testing.T) {
+	conn := listenNotify(t)
+	m := &master{}
+	m.recycleBegin()
+	if !m.reloading() {
+		t.Fatal("a recycle is not tracked as a reload")
+	}
+	m.reloadDone(true)
+	if got := readNotify(t, conn, 100*time.Millisecond); got != "" {
+		t.Fatalf("a recycle sent %q", got)
+	}
+}
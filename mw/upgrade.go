@@ -0,0 +1,176 @@
+package mw
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tddhit/box/mw/common"
+	"github.com/tddhit/box/socket"
+	"github.com/tddhit/tools/log"
+)
+
+// In-place binary upgrade, like nginx:
+//
+//  1. old master receives SIGUSR2, renames its pid file to xx.pid.oldbin and
+//     execs the binary again with a socketpair at fd 3.
+//  2. old master passes all of its listeners over the socketpair.
+//  3. new master inherits them, saves xx.pid and forks its workers.
+//  4. once every new worker has taken over, new master sends
+//     msgUpgradeReady, old master drains its workers and exits.
+//
+// If the new master exits or is not ready within upgradeTimeout, old master
+// kills it and restores its pid file.
+
+const defaultUpgradeTimeout = 30 * time.Second
+
+var (
+	errUpgradeTimeout = errors.New("upgrade timeout")
+	errUpgradeMsg     = errors.New("unexpected upgrade message")
+)
+
+func (m *master) upgrade() {
+	if !atomic.CompareAndSwapInt32(&m.upgrading, 0, 1) {
+		log.Warnf("UpgradeInProgress\tPid=%d\n", m.pid)
+		return
+	}
+	defer atomic.StoreInt32(&m.upgrading, 0)
+
+	pidPath := m.pidPath
+	oldPath := pidPath + ".oldbin"
+	if err := os.Rename(pidPath, oldPath); err != nil {
+		log.Errorf("UpgradeFail\tPid=%d\tErr=%s\n", m.pid, err.Error())
+		return
+	}
+	pid, uc, err := m.execMaster()
+	if err != nil {
+		log.Errorf("UpgradeFail\tPid=%d\tErr=%s\n", m.pid, err.Error())
+		m.rollback(pid, oldPath, pidPath)
+		return
+	}
+	log.Infof("UpgradeStart\tPid=%d\tNewPid=%d\n", m.pid, pid)
+	if err := m.waitUpgrade(newMsgConn(uc)); err != nil {
+		log.Errorf("UpgradeFail\tPid=%d\tNewPid=%d\tErr=%s\n",
+			m.pid, pid, err.Error())
+		m.rollback(pid, oldPath, pidPath)
+		return
+	}
+	log.Infof("UpgradeSuccess\tPid=%d\tNewPid=%d\n", m.pid, pid)
+	m.pidPath = oldPath
+	m.upgradeC <- struct{}{}
+}
+
+// execMaster starts the new master binary, which talks back over uc.
+func (m *master) execMaster() (pid int, uc *net.UnixConn, err error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return
+	}
+	syscall.CloseOnExec(fds[0])
+	defer syscall.Close(fds[1])
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, common.UPGRADE+"=") {
+			env = append(env, kv)
+		}
+	}
+	execSpec := &syscall.ProcAttr{
+		Env: append(env, common.UPGRADE+"=1"),
+		Files: []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd(),
+			uintptr(fds[1])},
+	}
+	file := os.NewFile(uintptr(fds[0]), "")
+	conn, err := net.FileConn(file)
+	file.Close()
+	if err != nil {
+		return
+	}
+	uc = conn.(*net.UnixConn)
+	if pid, err = syscall.ForkExec(os.Args[0], os.Args, execSpec); err != nil {
+		uc.Close()
+		return
+	}
+	if err = socket.SendListeners(uc); err != nil {
+		// the new master gets EOF and exits.
+		uc.Close()
+		return
+	}
+	return
+}
+
+// waitUpgrade waits for msgUpgradeReady from the new master.
+func (m *master) waitUpgrade(conn *msgConn) error {
+	defer conn.close()
+
+	errC := make(chan error, 1)
+	go func() {
+		msg, err := conn.read("master", m.pid)
+		if err == nil && msg.Typ != msgUpgradeReady {
+			err = errUpgradeMsg
+		}
+		errC <- err
+	}()
+	select {
+	case err := <-errC:
+		return err
+	case <-time.After(m.upgradeTimeout):
+		return errUpgradeTimeout
+	}
+}
+
+// rollback kills the new master, whose workers exit by themselves once their
+// parent is gone, and gives the pid file back to the old master.
+func (m *master) rollback(pid int, oldPath, pidPath string) {
+	if pid > 0 {
+		if p, err := os.FindProcess(pid); err == nil {
+			p.Signal(syscall.SIGKILL)
+			p.Wait()
+		}
+	}
+	if err := os.Rename(oldPath, pidPath); err != nil {
+		log.Error(err)
+	}
+	log.Warnf("UpgradeRollback\tPid=%d\tNewPid=%d\n", m.pid, pid)
+}
+
+// inheritParent is called by the new master to get the socketpair to the old
+// master, after the listeners have been received.
+func inheritParent() *msgConn {
+	if err := socket.Inherit(); err != nil {
+		log.Fatal(err)
+	}
+	file := os.NewFile(3, "")
+	conn, err := net.FileConn(file)
+	file.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		log.Fatal("invalid parent conn")
+	}
+	os.Unsetenv(common.UPGRADE)
+	return newMsgConn(uc)
+}
+
+// upgradeTakeover is called by the new master when one of its workers
+// takes over, the old master is told once all of them did.
+func (m *master) upgradeTakeover() {
+	if m.parent == nil {
+		return
+	}
+	if atomic.AddInt32(&m.takeovers, 1) != atomic.LoadInt32(&m.workerNum) {
+		return
+	}
+	if err := m.parent.write(&message{Typ: msgUpgradeReady}); err != nil {
+		log.Errorf("WriteMsg\tPid=%d\tErr=%s\n", m.pid, err.Error())
+	} else {
+		log.Infof("WriteMsg\tPid=%d\tMsg=%s\n", m.pid, msgUpgradeReady)
+	}
+	m.parent.close()
+}
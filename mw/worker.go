@@ -1,9 +1,8 @@
 package mw
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
+	"math"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
@@ -12,9 +11,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tddhit/box/confcenter"
 	"github.com/tddhit/box/socket"
 	"github.com/tddhit/box/stats"
 	"github.com/tddhit/box/transport"
@@ -22,17 +24,43 @@ import (
 )
 
 var (
-	ok = []byte(`{"code":200}`)
+	ok       = []byte(`{"code":200}`)
+	notReady = []byte(`{"code":503}`)
 )
 
 type worker struct {
 	addr string
 	pid  int
 	ppid int
-	uc   *net.UnixConn
+	slot int
+	conn *msgConn
 	wg   sync.WaitGroup
 
-	servers []*transport.Server
+	// Serve returns as soon as the listener is closed, the worker waits
+	// for the drain before exiting.
+	closeWG sync.WaitGroup
+
+	shutdownTimeout time.Duration
+
+	warmups          []func(ctx context.Context) error
+	readinessCheck   func(ctx context.Context) error
+	readinessTimeout time.Duration
+	ready            int32
+	closing          int32
+	cpu              uint64 // float64 bits of the CPUs used in the last second
+
+	hooks         *hooks
+	admin         *http.Server
+	probe         *probeListener
+	servers       []*transport.Server
+	confCenter    *confcenter.ConfCenter
+	confValidator func(raw []byte) error
+
+	// single-process mode only, see single.go
+	masterAddr string
+	ctlToken   string
+	master     *http.Server
+	started    time.Time
 }
 
 func newWorker(ctx context.Context) *worker {
@@ -41,60 +69,127 @@ func newWorker(ctx context.Context) *worker {
 		addr: f.workerAddr,
 		pid:  os.Getpid(),
 
-		servers: f.servers,
+		masterAddr: f.masterAddr,
+		ctlToken:   f.ctlToken,
+		master:     &http.Server{},
+		started:    time.Now(),
+
+		servers:       f.servers,
+		confCenter:    f.confCenter,
+		confValidator: f.confValidator,
+		hooks:         f.hooks,
+
+		shutdownTimeout: f.shutdownTimeout,
+
+		warmups:          f.warmups,
+		readinessCheck:   f.readinessCheck,
+		readinessTimeout: f.readinessTimeout,
+	}
+	w.admin = &http.Server{Handler: w.adminMux()}
+	w.probe = newProbeListener()
+	w.slot, _ = strconv.Atoi(os.Getenv("SLOT"))
+	if singleProcess() {
+		log.Infof("SingleProcess\tPid=%d\n", w.pid)
+		return w
 	}
 	ppid := os.Getenv("PPID")
 	w.ppid, _ = strconv.Atoi(ppid)
+	// listeners passed by master come first on the socketpair, consume them
+	// even if no transport.Listen has been called.
+	if err := socket.Inherit(); err != nil {
+		log.Fatal(err)
+	}
 	file := os.NewFile(3, "")
 	if conn, err := net.FileConn(file); err != nil {
 		log.Fatal(err)
 	} else {
 		if uc, ok := conn.(*net.UnixConn); ok {
-			w.uc = uc
+			w.conn = newMsgConn(uc)
 		} else {
 			log.Fatal(err)
 		}
 	}
+	if f.limits != nil {
+		// the master may have scaled since, its count is the one to use.
+		workerNum, err := strconv.Atoi(os.Getenv("WORKERNUM"))
+		if err != nil {
+			workerNum = f.workerNum
+		}
+		applyLimits(f.limits, w.slot, workerNum)
+	}
 	return w
 }
 
 func (w *worker) run() {
-	go w.watchMaster()
+	if w.conn != nil {
+		go w.watchMaster()
+	} else {
+		go w.watchConf()
+		go w.serveMaster()
+		go watchdog(watchdogInterval(false), &w.closing)
+	}
 	go w.watchSignal()
 	go w.calcQPS()
 	go w.serve()
 
-	if w.servers != nil {
-		for _, server := range w.servers {
-			w.wg.Add(1)
-			go func() {
-				server.Serve()
-				w.wg.Done()
-			}()
-			// make sure msgQuit can stop server when readMsg receive msg
-			<-server.Started()
-			server.RegisterAddr()
-		}
+	reason := workerReason()
+	err := w.hooks.run("OnWorkerStart", w.hooks.workerStart, w.event(reason))
+	if err != nil {
+		log.Fatalf("WorkerStartFail\tPid=%d\tErr=%s\n", w.pid, err.Error())
 	}
-
-	time.Sleep(100 * time.Millisecond)
-	go w.readMsg()
-
-	reason := os.Getenv("REASON")
-	if reason == reasonReload {
+	// only the admin server runs while warming up, the listeners are left to
+	// the old worker until this one is ready.
+	if w.conn != nil {
+		go w.readMsg()
+	}
+	if err := w.waitReady(); err != nil {
+		log.Fatalf("WorkerNotReady\tPid=%d\tErr=%s\n", w.pid, err.Error())
+	}
+	err = w.hooks.run("OnWorkerReady", w.hooks.workerReady, w.event(reason))
+	if err != nil {
+		log.Fatalf("WorkerNotReady\tPid=%d\tErr=%s\n", w.pid, err.Error())
+	}
+	// told to quit while warming up.
+	if atomic.LoadInt32(&w.closing) == 1 {
+		goto exit
+	}
+	for _, server := range w.servers {
+		w.wg.Add(1)
+		go func(server *transport.Server) {
+			server.Serve()
+			w.wg.Done()
+		}(server)
+		// make sure msgQuit can stop server when readMsg receive msg
+		<-server.Started()
+	}
+	for _, server := range w.servers {
+		server.RegisterAddr()
+	}
+	if w.conn == nil {
+		sdNotify(sdReady)
+	} else if reason == reasonReload || reason == reasonUpgrade {
 		if err := w.notifyMaster(&message{Typ: msgTakeover}); err == nil {
 			log.Infof("WriteMsg\tPid=%d\tMsg=%s\n", w.pid, msgTakeover)
 		}
+	} else {
+		w.notifyMaster(&message{Typ: msgReady})
 	}
 	log.Infof("WorkerStart\tPid=%d\tReason=%s\n", w.pid, reason)
+exit:
 	w.wg.Wait()
+	w.closeWG.Wait()
 	log.Infof("WorkerEnd\tPid=%d\n", w.pid)
 }
 
 func (w *worker) calcQPS() {
+	used, at := cpuTime(), time.Now()
 	tick := time.Tick(time.Second)
-	for range tick {
+	for now := range tick {
 		stats.GlobalStats().Calculate()
+		t := cpuTime()
+		cpu := float64(t-used) / float64(now.Sub(at))
+		atomic.StoreUint64(&w.cpu, math.Float64bits(cpu))
+		used, at = t, now
 	}
 }
 
@@ -111,19 +206,31 @@ func (w *worker) watchMaster() {
 }
 
 func (w *worker) watchSignal() {
-	signalC := make(chan os.Signal)
+	signalC := make(chan os.Signal, 1)
 	signal.Notify(signalC)
+	defer signal.Stop(signalC)
 	for {
 		select {
 		case sig := <-signalC:
 			log.Infof("WatchSignal\tPid=%d\tSig=%s\n", w.pid, sig.String())
+			// a forked worker is driven by the master.
+			if w.conn != nil {
+				continue
+			}
+			switch sig {
+			case syscall.SIGHUP:
+				log.Reopen()
+			case syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM:
+				w.close()
+				return
+			}
 		}
 	}
 }
 
 func (w *worker) readMsg() {
 	for {
-		msg, err := readMsg(w.uc, "worker", w.pid)
+		msg, err := w.conn.read("worker", w.pid)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -131,6 +238,14 @@ func (w *worker) readMsg() {
 		case msgQuit:
 			log.Infof("ReadMsg\tPid=%d\tMsg=%s\n", w.pid, msg.Typ)
 			goto exit
+		case msgPing:
+			go w.pong(msg)
+		case msgCustom:
+			go w.conn.handleCustom(msg)
+		case msgConfig:
+			go w.applyConf(msg)
+		case msgStats:
+			go w.replyStats(msg)
 		}
 	}
 exit:
@@ -138,33 +253,42 @@ exit:
 }
 
 func (w *worker) notifyMaster(msg *message) (err error) {
-	var buf bytes.Buffer
-	gob.NewEncoder(&buf).Encode(msg)
-	if _, _, err = w.uc.WriteMsgUnix(buf.Bytes(), nil, nil); err != nil {
+	if err = w.conn.write(msg); err != nil {
 		log.Errorf("WriteMsg\tPid=%d\tErr=%s\n", w.pid, err.Error())
 		return
 	}
 	return
 }
 
-func (w *worker) serve() {
-	http.HandleFunc("/status", w.doStatus)
-	http.HandleFunc("/stats", w.doStats)
-	http.HandleFunc("/stats.html", w.doStatsHTML)
-	http.Handle("/metrics", promhttp.Handler())
+// adminMux serves the worker endpoints, and the ones registered on
+// http.DefaultServeMux such as pprof.
+func (w *worker) adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", w.doStatus)
+	mux.HandleFunc("/stats", w.doStats)
+	mux.HandleFunc("/stats.html", w.doStatsHTML)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/", http.DefaultServeMux)
+	return mux
+}
 
-	//http.Handle("/metrics", promhttp.Handler())
+func (w *worker) serve() {
 	lis, err := socket.Listen(w.addr)
 	if err != nil {
 		log.Fatal(err)
 	}
-	srv := &http.Server{Handler: http.DefaultServeMux}
-	if err := srv.Serve(lis); err != nil {
+	go w.admin.Serve(w.probe)
+	if err := w.admin.Serve(lis); err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
 }
 
 func (w *worker) doStatus(rsp http.ResponseWriter, req *http.Request) {
+	if !w.isReady() {
+		rsp.WriteHeader(http.StatusServiceUnavailable)
+		rsp.Write(notReady)
+		return
+	}
 	rsp.Write(ok)
 }
 
@@ -192,10 +316,3 @@ func (w *worker) doStatsHTML(rsp http.ResponseWriter, req *http.Request) {
 	rsp.Header().Set("Content-Type", "text/html; charset=utf-8")
 	rsp.Write([]byte(html))
 }
-
-func (w *worker) close() {
-	for _, s := range w.servers {
-		s.UnregisterAddr()
-		s.Close()
-	}
-}
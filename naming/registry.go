@@ -2,6 +2,7 @@ package naming
 
 import (
 	"context"
+	"net"
 	"os"
 	"time"
 
@@ -28,6 +29,7 @@ func NewRegistry(ec *etcd.Client, opts ...RegistryOption) *Registry {
 }
 
 func (r *Registry) Register(serviceName, addr string) context.CancelFunc {
+	addr = canonicalAddr(addr)
 	done := make(chan struct{})
 	ctx, cancel := context.WithCancel(context.Background())
 	key := serviceName + "/" + addr
@@ -75,6 +77,19 @@ func (r *Registry) Register(serviceName, addr string) context.CancelFunc {
 	return cancel
 }
 
+// canonicalAddr formats the ip of addr the way net does, so that an IPv6 addr
+// is registered under one key however it was written, e.g. [fd00::1]:80.
+func canonicalAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return net.JoinHostPort(host, port)
+}
+
 func (r *Registry) TTL() int64 {
 	return r.opt.ttl
 }
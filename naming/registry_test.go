@@ -0,0 +1,23 @@
+package naming
+
+import "testing"
+
+func TestCanonicalAddr(t *testing.T) {
+	tests := []struct {
+		addr, want string
+	}{
+		{"10.0.0.1:80", "10.0.0.1:80"},
+		{"[fd00::1]:80", "[fd00::1]:80"},
+		{"[fd00:0:0:0:0:0:0:1]:80", "[fd00::1]:80"},
+		{"[FD00::0001]:80", "[fd00::1]:80"},
+		{"[::ffff:10.0.0.1]:80", "10.0.0.1:80"},
+		{"[fe80::1%eth0]:80", "[fe80::1%eth0]:80"},
+		{"localhost:80", "localhost:80"},
+		{"10.0.0.1", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		if got := canonicalAddr(tt.addr); got != tt.want {
+			t.Errorf("canonicalAddr(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
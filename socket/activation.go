@@ -0,0 +1,103 @@
+package socket
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/tddhit/tools/log"
+)
+
+// systemd socket activation, see sd_listen_fds(3). The listeners passed by
+// systemd are matched by their FileDescriptorName or their bound address or
+// socket path.
+
+// listenFDsStart is SD_LISTEN_FDS_START, the tests move it past their fds.
+var listenFDsStart = 3
+
+type activatedFD struct {
+	fd   int
+	name string
+	addr *net.TCPAddr
+	path string // unix domain socket
+	used bool
+}
+
+var (
+	activated     []*activatedFD
+	activatedMu   sync.Mutex
+	activatedOnce sync.Once
+)
+
+func loadActivated() {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// the children must not take them for their own.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != os.Getpid() || n <= 0 {
+		return
+	}
+	for i := 0; i < n; i++ {
+		a := &activatedFD{fd: listenFDsStart + i}
+		syscall.CloseOnExec(a.fd)
+		if i < len(names) {
+			a.name = names[i]
+		}
+		if sa, err := syscall.Getsockname(a.fd); err == nil {
+			a.addr = sockaddrToTCP(sa)
+			if sa, ok := sa.(*syscall.SockaddrUnix); ok {
+				a.path = sa.Name
+			}
+		}
+		activated = append(activated, a)
+	}
+}
+
+func sockaddrToTCP(sa syscall.Sockaddr) *net.TCPAddr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.TCPAddr{IP: append(net.IP{}, sa.Addr[:]...), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		return &net.TCPAddr{IP: append(net.IP{}, sa.Addr[:]...), Port: sa.Port}
+	}
+	return nil
+}
+
+// match reports whether the activated listener serves addr, a wildcard
+// listener serves every ip of its port.
+func (a *activatedFD) match(addr string, tcpAddr *net.TCPAddr) bool {
+	if a.name == addr || (a.path != "" && unixKey(a.path) == addr) {
+		return true
+	}
+	if a.addr == nil || tcpAddr == nil || a.addr.Port != tcpAddr.Port {
+		return false
+	}
+	return a.addr.IP.IsUnspecified() || a.addr.IP.Equal(tcpAddr.IP)
+}
+
+// takeActivated returns the fd passed by systemd for addr, if any.
+func takeActivated(addr string) (int, bool) {
+	if isWorker() || isUpgrade() {
+		return 0, false
+	}
+	activatedOnce.Do(loadActivated)
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+
+	activatedMu.Lock()
+	defer activatedMu.Unlock()
+	for _, a := range activated {
+		if !a.used && a.match(addr, tcpAddr) {
+			a.used = true
+			log.Infof("ActivatedListener\tPid=%d\tAddr=%s\tName=%s\n",
+				os.Getpid(), addr, a.name)
+			return a.fd, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,111 @@
+package socket
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// activate passes the fds of liss as systemd does, at consecutive fds from
+// listenFDsStart.
+func activate(t *testing.T, names string, liss ...net.Listener) {
+	const start = 200
+	for i, lis := range liss {
+		var f *os.File
+		var err error
+		switch l := lis.(type) {
+		case *net.TCPListener:
+			f, err = l.File()
+		case *net.UnixListener:
+			f, err = l.File()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Dup2(int(f.Fd()), start+i); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	listenFDsStart = start
+	activated, activatedOnce = nil, sync.Once{}
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(len(liss)))
+	t.Setenv("LISTEN_FDNAMES", names)
+	t.Cleanup(func() {
+		for i := range liss {
+			syscall.Close(start + i)
+		}
+		listenFDsStart = 3
+		activated, activatedOnce = nil, sync.Once{}
+	})
+}
+
+func TestTakeActivated(t *testing.T) {
+	named, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer named.Close()
+	byAddr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer byAddr.Close()
+	wildcard, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wildcard.Close()
+	path := filepath.Join(t.TempDir(), "activated.sock")
+	unix, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close()
+	activate(t, "web:::", named, byAddr, wildcard, unix)
+
+	wildcardPort := wildcard.Addr().(*net.TCPAddr).Port
+	tests := []struct {
+		addr string
+		fd   int
+		ok   bool
+	}{
+		{"web", 200, true},
+		{"web", 0, false}, // taken already
+		{byAddr.Addr().String(), 201, true},
+		{"10.1.2.3:" + strconv.Itoa(wildcardPort), 202, true},
+		{unixKey(path), 203, true},
+		{"127.0.0.1:1", 0, false},
+		{"api", 0, false},
+	}
+	for _, tt := range tests {
+		fd, ok := takeActivated(tt.addr)
+		if fd != tt.fd || ok != tt.ok {
+			t.Errorf("takeActivated(%s) = %d, %v, want %d, %v",
+				tt.addr, fd, ok, tt.fd, tt.ok)
+		}
+	}
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if v, ok := os.LookupEnv(env); ok {
+			t.Errorf("%s=%s is left for the children", env, v)
+		}
+	}
+}
+
+func TestTakeActivatedOtherPid(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	activate(t, "web", lis)
+	os.Setenv("LISTEN_PID", "1")
+	if fd, ok := takeActivated("web"); ok {
+		t.Fatalf("took fd %d passed to another pid", fd)
+	}
+}
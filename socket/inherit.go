@@ -0,0 +1,214 @@
+package socket
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	mwcommon "github.com/tddhit/box/mw/common"
+	"github.com/tddhit/tools/log"
+)
+
+const maxInheritFDs = 64
+
+// masterFD is the parent end of the socketpair, always the 4th file of a
+// worker or an upgraded master. The tests move it to their socketpair.
+var masterFD = 3
+
+var (
+	errTooManyFDs = errors.New("too many listeners to pass")
+
+	// master: listeners bound by Listen, key: addr, value: *ownedFile
+	owned sync.Map
+
+	// worker/upgraded master: listeners received from parent,
+	// key: addr, value: fd
+	inherited   = make(map[string]int)
+	inheritMu   sync.Mutex
+	inheritOnce sync.Once
+	inheritErr  error
+)
+
+func isWorker() bool {
+	return os.Getenv(mwcommon.FORK) == "1"
+}
+
+// isUpgrade reports whether it is a new master exec'ed by the old one.
+func isUpgrade() bool {
+	return !isWorker() && os.Getenv(mwcommon.UPGRADE) == "1"
+}
+
+// ownedFile keeps the raw fd besides the file, since File.Fd would put the
+// socket shared with the workers into blocking mode.
+type ownedFile struct {
+	*os.File
+	fd int
+}
+
+// own keeps the listening socket of addr open in the master so that it can be
+// passed to every worker it forks.
+func own(addr string, file *os.File, fd int) {
+	owned.Store(addr, &ownedFile{file, fd})
+}
+
+// Release closes the listening sockets kept for the workers, so that their
+// ports are freed once the listeners are closed. It is used by a process
+// which serves by itself instead of forking workers.
+func Release() {
+	owned.Range(func(key, value interface{}) bool {
+		value.(*ownedFile).Close()
+		owned.Delete(key)
+		return true
+	})
+}
+
+// SendListeners passes the listeners owned by the master, except the ones of
+// skip, to a worker or a new master with SCM_RIGHTS. It must be the first
+// message written to uc.
+//
+// wire format: 4 bytes big-endian length | addrs joined by '\n'
+// the fds are attached to the first byte in the same order as addrs.
+func SendListeners(uc *net.UnixConn, skip ...string) error {
+	var (
+		addrs []string
+		fds   []int
+	)
+	owned.Range(func(key, value interface{}) bool {
+		for _, addr := range skip {
+			if addr == key.(string) {
+				return true
+			}
+		}
+		addrs = append(addrs, key.(string))
+		fds = append(fds, value.(*ownedFile).fd)
+		return true
+	})
+	if len(fds) > maxInheritFDs {
+		return errTooManyFDs
+	}
+	payload := strings.Join(addrs, "\n")
+	buf := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	copy(buf[4:], payload)
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	if _, _, err := uc.WriteMsgUnix(buf, oob, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Inherit receives the listeners passed by SendListeners. It is called once
+// per worker or upgraded master, before anything else reads from the
+// socketpair.
+func Inherit() error {
+	if !isWorker() && !isUpgrade() {
+		return nil
+	}
+	inheritOnce.Do(func() {
+		inheritErr = recvListeners()
+		if inheritErr != nil {
+			log.Error(inheritErr)
+		}
+	})
+	return inheritErr
+}
+
+func recvListeners() error {
+	head := make([]byte, 4)
+	oob := make([]byte, syscall.CmsgSpace(maxInheritFDs*4))
+	n, oobn, _, _, err := syscall.Recvmsg(masterFD, head, oob, 0)
+	if err != nil {
+		return err
+	}
+	if n != len(head) {
+		if err := readFull(masterFD, head[n:]); err != nil {
+			return err
+		}
+	}
+	var fds []int
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			rights, err := syscall.ParseUnixRights(&msg)
+			if err != nil {
+				return err
+			}
+			fds = append(fds, rights...)
+		}
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(head))
+	if err := readFull(masterFD, payload); err != nil {
+		return err
+	}
+	var addrs []string
+	if len(payload) > 0 {
+		addrs = strings.Split(string(payload), "\n")
+	}
+	if len(addrs) != len(fds) {
+		return errors.New("mismatched inherited listeners")
+	}
+	inheritMu.Lock()
+	defer inheritMu.Unlock()
+	for i, addr := range addrs {
+		syscall.CloseOnExec(fds[i])
+		inherited[addr] = fds[i]
+	}
+	return nil
+}
+
+func readFull(fd int, buf []byte) error {
+	for len(buf) > 0 {
+		n, err := syscall.Read(fd, buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errors.New("socketpair closed")
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+// takeInherited returns the fd passed by the parent for addr, if any.
+func takeInherited(addr string) (int, bool) {
+	if Inherit() != nil {
+		return 0, false
+	}
+	inheritMu.Lock()
+	defer inheritMu.Unlock()
+	fd, ok := inherited[addr]
+	delete(inherited, addr)
+	if ok {
+		log.Infof("InheritListener\tPid=%d\tAddr=%s\n", os.Getpid(), addr)
+	}
+	return fd, ok
+}
+
+// fileListener wraps a listening fd, the master keeps the fd open so that
+// it can be passed on.
+func fileListener(addr string, fd int) (lis net.Listener, err error) {
+	file := os.NewFile(uintptr(fd), addr)
+	lis, err = net.FileListener(file)
+	if err != nil {
+		log.Error(err)
+		file.Close()
+		return
+	}
+	if isWorker() {
+		file.Close()
+	} else {
+		own(addr, file, fd)
+	}
+	return
+}
@@ -0,0 +1,164 @@
+package socket
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	mwcommon "github.com/tddhit/box/mw/common"
+)
+
+// fork passes the owned listeners but skip to a fake worker, which is this
+// process with masterFD at the child end of a socketpair.
+func fork(t *testing.T, skip ...string) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(fds[0]), "master")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := SendListeners(conn.(*net.UnixConn), skip...); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(mwcommon.FORK, "1")
+	masterFD = fds[1]
+	inheritMu.Lock()
+	inherited = make(map[string]int)
+	inheritMu.Unlock()
+	inheritOnce, inheritErr = sync.Once{}, nil
+	t.Cleanup(func() {
+		syscall.Close(fds[1])
+		masterFD = 3
+		inheritMu.Lock()
+		for _, fd := range inherited {
+			syscall.Close(fd)
+		}
+		inherited = make(map[string]int)
+		inheritMu.Unlock()
+		inheritOnce, inheritErr = sync.Once{}, nil
+	})
+}
+
+// accepts checks that lis accepts the connections to addr.
+func accepts(t *testing.T, lis net.Listener, network, addr string) {
+	c, err := net.DialTimeout(network, addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	done := make(chan error, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		lis.Close()
+		t.Fatalf("%s does not accept %s", lis.Addr(), addr)
+	}
+}
+
+func TestSendListeners(t *testing.T) {
+	defer Release()
+	defer RemoveUnix()
+
+	// the listeners of the master: bound, activated and skipped ones.
+	tcp, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	path := filepath.Join(t.TempDir(), "echo.sock")
+	unix, err := ListenUnix(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close()
+	systemd, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer systemd.Close()
+	activate(t, "", systemd)
+	activatedAddr := systemd.Addr().String()
+	act, err := Listen(activatedAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer act.Close()
+	skipped, err := Listen("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skipped.Close()
+
+	// a worker and, after a reload, the next one get the same sockets.
+	for i := 0; i < 2; i++ {
+		fork(t, "localhost:0")
+
+		lis, err := Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lis.Addr().String() != tcp.Addr().String() {
+			t.Fatalf("got %s, want %s", lis.Addr(), tcp.Addr())
+		}
+		accepts(t, lis, "tcp", tcp.Addr().String())
+		lis.Close()
+
+		// the socket file of the master is used, not bound again.
+		lis, err = ListenUnix(path, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepts(t, lis, "unix", path)
+		lis.Close()
+
+		lis, err = Listen(activatedAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepts(t, lis, "tcp", activatedAddr)
+		lis.Close()
+
+		if fd, ok := takeInherited("localhost:0"); ok {
+			syscall.Close(fd)
+			t.Fatal("a skipped listener was passed")
+		}
+		if _, ok := takeInherited("127.0.0.1:0"); ok {
+			t.Fatal("a listener was taken twice")
+		}
+	}
+	// the master keeps its listeners for the next worker.
+	accepts(t, tcp, "tcp", tcp.Addr().String())
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendListenersNone(t *testing.T) {
+	fork(t)
+	if err := Inherit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(inherited) != 0 {
+		t.Fatalf("inherited %v", inherited)
+	}
+}
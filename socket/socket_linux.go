@@ -2,29 +2,52 @@ package socket
 
 import (
 	"net"
-	"os"
 
 	"golang.org/x/sys/unix"
 
 	"github.com/tddhit/tools/log"
 )
 
+// Listen returns the listener passed by the parent when called in a worker
+// or an upgraded master, or by systemd socket activation, otherwise binds a
+// new one. Listeners of the master are kept open and passed to the workers,
+// so that reloads never drop connections.
 func Listen(addr string) (lis net.Listener, err error) {
+	if fd, ok := takeInherited(addr); ok {
+		return fileListener(addr, fd)
+	}
+	if fd, ok := takeActivated(addr); ok {
+		return fileListener(addr, fd)
+	}
 	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
 		log.Error(err)
 		return
 	}
-	sockaddr := &unix.SockaddrInet4{Port: tcpAddr.Port}
-	if ipv4 := tcpAddr.IP.To4(); ipv4 != nil {
-		addr := [4]byte{ipv4[0], ipv4[1], ipv4[2], ipv4[3]}
-		sockaddr.Addr = addr
+	family, sockaddr, dual := inetSockaddr(tcpAddr)
+	fd, err := unix.Socket(family, unix.SOCK_STREAM, unix.IPPROTO_TCP)
+	if err != nil && dual {
+		// no IPv6 on the host.
+		family, dual = unix.AF_INET, false
+		sockaddr = &unix.SockaddrInet4{Port: tcpAddr.Port}
+		fd, err = unix.Socket(family, unix.SOCK_STREAM, unix.IPPROTO_TCP)
 	}
-	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_TCP)
 	if err != nil {
 		log.Error(err)
 		return
 	}
+	unix.CloseOnExec(fd)
+	if family == unix.AF_INET6 {
+		v6only := 1
+		if dual {
+			v6only = 0
+		}
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, v6only)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+	}
 	err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
 	if err != nil {
 		log.Error(err)
@@ -45,11 +68,25 @@ func Listen(addr string) (lis net.Listener, err error) {
 		log.Error(err)
 		return
 	}
-	file := os.NewFile(uintptr(fd), "")
-	lis, err = net.FileListener(file)
-	if err != nil {
-		log.Error(err)
-		return
+	return fileListener(addr, fd)
+}
+
+// inetSockaddr returns the socket family and address of addr. A wildcard
+// addr, i.e. without ip or with ::, is dual-stack and accepts IPv4 as well.
+func inetSockaddr(addr *net.TCPAddr) (int, unix.Sockaddr, bool) {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		sa := &unix.SockaddrInet4{Port: addr.Port}
+		copy(sa.Addr[:], ip4)
+		return unix.AF_INET, sa, false
+	}
+	sa := &unix.SockaddrInet6{Port: addr.Port}
+	if addr.IP != nil {
+		copy(sa.Addr[:], addr.IP.To16())
+		if addr.Zone != "" {
+			if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+				sa.ZoneId = uint32(ifi.Index)
+			}
+		}
 	}
-	return
+	return unix.AF_INET6, sa, addr.IP == nil || addr.IP.IsUnspecified()
 }
@@ -0,0 +1,63 @@
+package socket
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestInetSockaddr(t *testing.T) {
+	tests := []struct {
+		addr   string
+		family int
+		ip     net.IP
+		dual   bool
+	}{
+		{"127.0.0.1:80", unix.AF_INET, net.IPv4(127, 0, 0, 1), false},
+		{"0.0.0.0:80", unix.AF_INET, net.IPv4zero, false},
+		{"[::ffff:10.0.0.1]:80", unix.AF_INET, net.IPv4(10, 0, 0, 1), false},
+		{":80", unix.AF_INET6, net.IPv6unspecified, true},
+		{"[::]:80", unix.AF_INET6, net.IPv6unspecified, true},
+		{"[::1]:80", unix.AF_INET6, net.IPv6loopback, false},
+		{"[fd00::1]:80", unix.AF_INET6, net.ParseIP("fd00::1"), false},
+	}
+	for _, tt := range tests {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		family, sa, dual := inetSockaddr(tcpAddr)
+		if family != tt.family || dual != tt.dual {
+			t.Errorf("inetSockaddr(%s) = %d, dual %v, want %d, dual %v",
+				tt.addr, family, dual, tt.family, tt.dual)
+			continue
+		}
+		var (
+			ip   net.IP
+			port int
+		)
+		switch sa := sa.(type) {
+		case *unix.SockaddrInet4:
+			ip, port = net.IP(sa.Addr[:]), sa.Port
+		case *unix.SockaddrInet6:
+			ip, port = net.IP(sa.Addr[:]), sa.Port
+		}
+		if !ip.Equal(tt.ip) || port != 80 {
+			t.Errorf("inetSockaddr(%s) = %s:%d, want %s:80",
+				tt.addr, ip, port, tt.ip)
+		}
+	}
+}
+
+func TestInetSockaddrZone(t *testing.T) {
+	ifi, err := net.InterfaceByIndex(1)
+	if err != nil {
+		t.Skip(err)
+	}
+	tcpAddr := &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 80, Zone: ifi.Name}
+	_, sa, _ := inetSockaddr(tcpAddr)
+	if sa6, ok := sa.(*unix.SockaddrInet6); !ok || sa6.ZoneId != 1 {
+		t.Fatalf("inetSockaddr(%s) = %+v, want zone 1", tcpAddr, sa)
+	}
+}
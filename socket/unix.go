@@ -0,0 +1,112 @@
+package socket
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tddhit/tools/log"
+)
+
+// Unix domain sockets are owned and passed to the workers like the TCP ones,
+// under the key "unix:" + path. The socket file is created by the master and
+// removed when it exits, a file left by a crashed master is removed by the
+// next one once nothing accepts on it.
+
+const staleDialTimeout = time.Second
+
+// unixPaths are the socket files the master removes on exit,
+// key: path, value: struct{}
+var unixPaths sync.Map
+
+func unixKey(path string) string {
+	return "unix:" + path
+}
+
+// ListenUnix is Listen for a unix domain socket at path. The socket file is
+// chmod to mode before accepting, unless mode is 0.
+func ListenUnix(path string, mode os.FileMode) (lis net.Listener, err error) {
+	key := unixKey(path)
+	if fd, ok := takeInherited(key); ok {
+		if isUpgrade() {
+			unixPaths.Store(path, struct{}{})
+		}
+		return fileListener(key, fd)
+	}
+	if fd, ok := takeActivated(key); ok {
+		return fileListener(key, fd)
+	}
+	if err = removeStale(path); err != nil {
+		log.Error(err)
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Error(err)
+		return
+	}
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	syscall.CloseOnExec(fd)
+	if err = bindUnix(fd, path, mode); err != nil {
+		log.Error(err)
+		syscall.Close(fd)
+		return
+	}
+	unixPaths.Store(path, struct{}{})
+	return fileListener(key, fd)
+}
+
+func bindUnix(fd int, path string, mode os.FileMode) error {
+	if err := syscall.Bind(fd, &syscall.SockaddrUnix{Name: path}); err != nil {
+		return &os.PathError{Op: "bind", Path: path, Err: err}
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			os.Remove(path)
+			return err
+		}
+	}
+	if err := syscall.Listen(fd, 128); err != nil {
+		os.Remove(path)
+		return &os.PathError{Op: "listen", Path: path, Err: err}
+	}
+	return nil
+}
+
+// removeStale removes the socket file at path if nothing accepts on it.
+func removeStale(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return &os.PathError{Op: "listen", Path: path, Err: syscall.ENOTSOCK}
+	}
+	if c, err := net.DialTimeout("unix", path, staleDialTimeout); err == nil {
+		c.Close()
+		return &os.PathError{Op: "listen", Path: path, Err: syscall.EADDRINUSE}
+	}
+	log.Infof("StaleSocket\tPid=%d\tPath=%s\n", os.Getpid(), path)
+	return os.Remove(path)
+}
+
+// RemoveUnix removes the socket files of the master. It is not called by a
+// master leaving after an upgrade, the new one keeps serving them.
+func RemoveUnix() {
+	unixPaths.Range(func(key, value interface{}) bool {
+		if err := os.Remove(key.(string)); err != nil && !os.IsNotExist(err) {
+			log.Error(err)
+		}
+		unixPaths.Delete(key)
+		return true
+	})
+}
@@ -26,6 +26,7 @@ type stats struct {
 	Method map[string]int `json:"method"`
 	Html   string         `json:"-"`
 	data   []byte
+	last   int // QPS of the last second
 }
 
 func newStats() *stats {
@@ -49,6 +50,7 @@ func (s *stats) Calculate() {
 		s.QPS += qps
 	}
 	s.data, _ = json.Marshal(s)
+	s.last = s.QPS
 
 	// reset
 	s.QPS = 0
@@ -57,6 +59,14 @@ func (s *stats) Calculate() {
 	}
 }
 
+// LastQPS returns the QPS of the last second.
+func (s *stats) LastQPS() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.last
+}
+
 func (s *stats) Bytes() []byte {
 	s.Lock()
 	defer s.Unlock()
@@ -0,0 +1,48 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+type peerKey struct{}
+
+// NewPeerContext keeps the TLS state of an http request in ctx, grpc keeps
+// its own.
+func NewPeerContext(ctx context.Context, state *tls.ConnectionState) context.Context {
+	return context.WithValue(ctx, peerKey{}, state)
+}
+
+// PeerCertificate returns the verified client certificate of the request of
+// ctx, on both transports. It is meant for middlewares.
+func PeerCertificate(ctx context.Context) (*x509.Certificate, bool) {
+	var state *tls.ConnectionState
+	if s, ok := ctx.Value(peerKey{}).(*tls.ConnectionState); ok {
+		state = s
+	} else if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil, false
+	}
+	return state.PeerCertificates[0], true
+}
+
+// PeerIdentity returns the first URI SAN of the client certificate, e.g. a
+// SPIFFE ID, or its common name, or "" without client certificate.
+func PeerIdentity(ctx context.Context) string {
+	cert, ok := PeerCertificate(ctx)
+	if !ok {
+		return ""
+	}
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	return cert.Subject.CommonName
+}
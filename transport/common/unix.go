@@ -0,0 +1,19 @@
+package common
+
+import "strings"
+
+// UnixPrefix marks the addr of a unix domain socket passed to the grpc and
+// http clients, e.g. unix:///run/echo.sock.
+const UnixPrefix = "unix://"
+
+// UnixHost is the authority of the requests over a unix domain socket, and
+// the server name verified by TLS unless one is set.
+const UnixHost = "localhost"
+
+// UnixPath returns the socket path of addr if it has UnixPrefix.
+func UnixPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, UnixPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, UnixPrefix), true
+}
@@ -2,9 +2,12 @@ package grpc
 
 import (
 	"context"
+	"net"
+	"time"
 
 	"google.golang.org/grpc"
 	_ "google.golang.org/grpc/balancer/roundrobin"
+	"google.golang.org/grpc/credentials"
 
 	"github.com/tddhit/box/interceptor"
 	_ "github.com/tddhit/box/resolver/etcd"
@@ -32,13 +35,30 @@ func DialContext(ctx context.Context, target string,
 		opts: ops,
 	}
 	var grpcOpts = []grpc.DialOption{
-		grpc.WithInsecure(),
 		grpc.WithUnaryInterceptor(c.unaryInterceptor),
 		grpc.WithStreamInterceptor(c.streamInterceptor),
 	}
+	if ops.UseTLS() {
+		tlsConf, err := ops.ClientTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		grpcOpts = append(grpcOpts,
+			grpc.WithTransportCredentials(credentials.NewTLS(tlsConf)))
+	} else {
+		grpcOpts = append(grpcOpts, grpc.WithInsecure())
+	}
 	if c.opts.Balancer != "" {
 		grpcOpts = append(grpcOpts, grpc.WithBalancerName(c.opts.Balancer))
 	}
+	if path, ok := common.UnixPath(target); ok {
+		target = path
+		grpcOpts = append(grpcOpts,
+			grpc.WithAuthority(common.UnixHost),
+			grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+				return net.DialTimeout("unix", addr, timeout)
+			}))
+	}
 	conn, err = grpc.DialContext(ctx, target, grpcOpts...)
 	if err != nil {
 		return nil, err
@@ -3,8 +3,10 @@ package grpc
 import (
 	"context"
 	"net"
+	"sync/atomic"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	"github.com/tddhit/box/interceptor"
 	"github.com/tddhit/box/transport/common"
@@ -13,9 +15,11 @@ import (
 
 type GrpcTransport struct {
 	*grpc.Server
-	opts    option.ServerOptions
-	lis     net.Listener
-	handler interceptor.UnaryHandler
+	opts     option.ServerOptions
+	lis      net.Listener
+	handler  interceptor.UnaryHandler
+	inflight int64
+	requests int64
 }
 
 func New(lis net.Listener,
@@ -29,10 +33,15 @@ func New(lis net.Listener,
 		opts: ops,
 		lis:  lis,
 	}
-	s.Server = grpc.NewServer(
+	grpcOpts := []grpc.ServerOption{
 		grpc.UnaryInterceptor(s.unaryInterceptor),
 		grpc.StreamInterceptor(s.streamInterceptor),
-	)
+	}
+	if ops.TLSConfig != nil {
+		grpcOpts = append(grpcOpts,
+			grpc.Creds(credentials.NewTLS(ops.TLSConfig)))
+	}
+	s.Server = grpc.NewServer(grpcOpts...)
 	return s
 }
 
@@ -40,6 +49,9 @@ func (s *GrpcTransport) unaryInterceptor(ctx context.Context,
 	req interface{}, info *grpc.UnaryServerInfo,
 	handler grpc.UnaryHandler) (interface{}, error) {
 
+	atomic.AddInt64(&s.requests, 1)
+	atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
 	f := func(ctx context.Context, req interface{},
 		info *common.UnaryServerInfo) (interface{}, error) {
 
@@ -53,6 +65,9 @@ func (s *GrpcTransport) unaryInterceptor(ctx context.Context,
 func (s *GrpcTransport) streamInterceptor(srv interface{}, ss grpc.ServerStream,
 	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
 
+	atomic.AddInt64(&s.requests, 1)
+	atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
 	f := func(srv interface{}, ss common.ServerStream,
 		info *common.StreamServerInfo) error {
 
@@ -69,11 +84,40 @@ func (s *GrpcTransport) Register(desc common.ServiceDesc,
 }
 
 func (s *GrpcTransport) Close() {
+	s.Shutdown(context.Background())
+}
+
+// Shutdown stops accepting and waits for the in-flight rpcs, the remaining
+// ones are closed once ctx is done.
+func (s *GrpcTransport) Shutdown(ctx context.Context) error {
 	if s.opts.FuncBeforeClose != nil {
 		s.opts.FuncBeforeClose()
 	}
-	s.Server.GracefulStop()
+	done := make(chan struct{})
+	go func() {
+		s.Server.GracefulStop()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.Server.Stop()
+		<-done
+	}
 	if s.opts.FuncAfterClose != nil {
 		s.opts.FuncAfterClose()
 	}
+	return err
+}
+
+// Inflight returns the number of rpcs being handled.
+func (s *GrpcTransport) Inflight() int64 {
+	return atomic.LoadInt64(&s.inflight)
+}
+
+// Requests returns the number of rpcs handled since start.
+func (s *GrpcTransport) Requests() int64 {
+	return atomic.LoadInt64(&s.requests)
 }
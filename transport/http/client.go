@@ -3,10 +3,13 @@ package http
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/golang/protobuf/jsonpb"
@@ -19,6 +22,7 @@ import (
 
 type HttpClient struct {
 	*http.Client
+	scheme      string
 	addr        string
 	opt         option.DialOptions
 	marshaler   *jsonpb.Marshaler
@@ -32,18 +36,36 @@ func DialContext(ctx context.Context, target string,
 	for _, o := range opts {
 		o(&opt)
 	}
+	dialer := &net.Dialer{
+		Timeout:   500 * time.Millisecond,
+		KeepAlive: time.Second,
+	}
+	tr := &http.Transport{
+		Dial:            dialer.Dial,
+		MaxIdleConns:    0,
+		IdleConnTimeout: time.Second,
+	}
+	if path, ok := common.UnixPath(target); ok {
+		target = common.UnixHost
+		tr.Dial = func(network, addr string) (net.Conn, error) {
+			return dialer.Dial("unix", path)
+		}
+	}
+	scheme := "http"
+	if opt.UseTLS() {
+		tlsConf, err := opt.ClientTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		tr.TLSClientConfig = tlsConf
+		scheme = "https"
+	}
 	c := &HttpClient{
 		Client: &http.Client{
-			Transport: &http.Transport{
-				Dial: (&net.Dialer{
-					Timeout:   500 * time.Millisecond,
-					KeepAlive: time.Second,
-				}).Dial,
-				MaxIdleConns:    0,
-				IdleConnTimeout: time.Second,
-			},
-			Timeout: 500 * time.Millisecond,
+			Transport: tr,
+			Timeout:   500 * time.Millisecond,
 		},
+		scheme:      scheme,
 		addr:        target,
 		opt:         opt,
 		marshaler:   &jsonpb.Marshaler{EnumsAsInts: true},
@@ -52,16 +74,20 @@ func DialContext(ctx context.Context, target string,
 	return c, nil
 }
 
+// Invoke sends args as the HTTPRule of opts, or POSTs it to the method path
+// if there is none. The errors are status errors, as those of grpc.
 func (c *HttpClient) Invoke(ctx context.Context, method string,
 	args interface{}, reply interface{}, opts ...option.CallOption) error {
 
-	var buf bytes.Buffer
-	if err := c.marshaler.Marshal(&buf, args.(proto.Message)); err != nil {
-		log.Error(err)
-		return err
+	var ops option.CallOptions
+	for _, o := range opts {
+		o(&ops)
+	}
+	rule := ops.HTTPRule
+	if rule == nil {
+		rule = &option.HTTPRule{Method: "POST", Path: method, Body: "*"}
 	}
-	url := fmt.Sprintf("http://%s%s", c.addr, method)
-	req, err := http.NewRequest("POST", url, &buf)
+	req, err := c.newRequest(ctx, rule, args.(proto.Message))
 	if err != nil {
 		log.Error(err)
 		return err
@@ -69,16 +95,81 @@ func (c *HttpClient) Invoke(ctx context.Context, method string,
 	rsp, err := c.Client.Do(req)
 	if err != nil {
 		log.Error(err)
-		return err
+		return transportError(ctx, err)
 	}
 	defer rsp.Body.Close()
-	if err = c.unmarshaler.Unmarshal(rsp.Body, reply.(proto.Message)); err != nil {
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return errorFromResponse(rsp)
+	}
+	var body io.Reader = rsp.Body
+	if rule.ResponseBody != "" {
+		// the reply with only the response_body field.
+		body = io.MultiReader(
+			strings.NewReader(`{"`+rule.ResponseBody+`":`), rsp.Body,
+			strings.NewReader("}"))
+	}
+	if err = c.unmarshaler.Unmarshal(body, reply.(proto.Message)); err != nil {
 		log.Error(err)
 		return err
 	}
 	return nil
 }
 
+// newRequest binds the fields of msg to the path variables, the body and the
+// query string as rule says.
+func (c *HttpClient) newRequest(ctx context.Context, rule *option.HTTPRule,
+	msg proto.Message) (*http.Request, error) {
+
+	var body io.Reader
+	if rule.Body == "*" {
+		var buf bytes.Buffer
+		if err := c.marshaler.Marshal(&buf, msg); err != nil {
+			return nil, err
+		}
+		body = &buf
+	}
+	// a path variable may be 0 or empty, the query string has only the
+	// fields which are set.
+	var values, fields map[string]interface{}
+	if strings.Contains(rule.Path, "{") {
+		var err error
+		if values, err = fieldValues(msg, true); err != nil {
+			return nil, err
+		}
+	}
+	if rule.Body != "*" {
+		var err error
+		if fields, err = fieldValues(msg, false); err != nil {
+			return nil, err
+		}
+	}
+	path, err := expandPath(rule.Path, values, fields)
+	if err != nil {
+		return nil, err
+	}
+	var query string
+	if rule.Body != "*" {
+		if rule.Body != "" {
+			b, err := json.Marshal(fields[rule.Body])
+			if err != nil {
+				return nil, err
+			}
+			body = bytes.NewReader(b)
+			delete(fields, rule.Body)
+		}
+		query = queryValues(fields).Encode()
+	}
+	url := fmt.Sprintf("%s://%s%s", c.scheme, c.addr, path)
+	if query != "" {
+		url += "?" + query
+	}
+	req, err := http.NewRequest(rule.Method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(ctx), nil
+}
+
 func (c *HttpClient) Close() {
 }
 
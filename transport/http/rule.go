@@ -0,0 +1,220 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/grpc-ecosystem/grpc-gateway/utilities"
+
+	"github.com/tddhit/box/transport/option"
+)
+
+// Rule is a google.api.http binding of a method with its compiled path
+// template. A method may have several, the first one is the primary binding
+// and the others are its additional_bindings.
+type Rule struct {
+	option.HTTPRule
+	Pattern runtime.Pattern
+}
+
+// rules returns the bindings of method. Code generated before Rules has
+// only Pattern, whose whole message is POSTed.
+func (sd *ServiceDesc) rules(method string) []Rule {
+	if rules, ok := sd.Rules[method]; ok {
+		return rules
+	}
+	if pattern, ok := sd.Pattern[method]; ok {
+		return []Rule{{
+			HTTPRule: option.HTTPRule{Method: "POST", Body: "*"},
+			Pattern:  pattern,
+		}}
+	}
+	return nil
+}
+
+// bind fills msg from the body, the path variables and the query string of
+// req as rule says. The query string is ignored if the body is the whole
+// message, and never overrides the path variables or the body field.
+func bind(msg proto.Message, rule *Rule, marshaler runtime.Marshaler,
+	req *http.Request, pathParams map[string]string) error {
+
+	switch rule.Body {
+	case "":
+	case "*":
+		err := marshaler.NewDecoder(req.Body).Decode(msg)
+		if err != nil && err != io.EOF {
+			return err
+		}
+	default:
+		f, err := fieldByName(msg, rule.Body)
+		if err != nil {
+			return err
+		}
+		err = marshaler.NewDecoder(req.Body).Decode(f.Addr().Interface())
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	var bound [][]string
+	for k, v := range pathParams {
+		if err := runtime.PopulateFieldFromPath(msg, k, v); err != nil {
+			return err
+		}
+		bound = append(bound, strings.Split(k, "."))
+	}
+	if rule.Body == "*" {
+		return nil
+	}
+	if rule.Body != "" {
+		bound = append(bound, []string{rule.Body})
+	}
+	return runtime.PopulateQueryParameters(msg, req.URL.Query(),
+		utilities.NewDoubleArray(bound))
+}
+
+// responseBody makes runtime.ForwardResponseMessage write only the
+// response_body field of the reply.
+type responseBody struct {
+	proto.Message
+	field string
+}
+
+func (r responseBody) XXX_ResponseBody() interface{} {
+	f, err := fieldByName(r.Message, r.field)
+	if err != nil {
+		return nil
+	}
+	return f.Interface()
+}
+
+// fieldByName returns the field of msg named name in the proto file.
+func fieldByName(msg proto.Message, name string) (reflect.Value, error) {
+	v := reflect.ValueOf(msg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		for _, s := range strings.Split(t.Field(i).Tag.Get("protobuf"), ",") {
+			if s == "name="+name {
+				return v.Field(i), nil
+			}
+		}
+	}
+	return reflect.Value{}, fmt.Errorf("no field %s in %s", name, t)
+}
+
+// fieldValues returns the fields of msg which are set, or all of them if
+// emitDefaults, keyed by their names in the proto file.
+func fieldValues(msg proto.Message,
+	emitDefaults bool) (map[string]interface{}, error) {
+
+	var buf bytes.Buffer
+	m := &jsonpb.Marshaler{OrigName: true, EmitDefaults: emitDefaults}
+	if err := m.Marshal(&buf, msg); err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	d := json.NewDecoder(&buf)
+	d.UseNumber()
+	err := d.Decode(&fields)
+	return fields, err
+}
+
+// expandPath replaces the variables of the path template tmpl with the
+// values they name, which are removed from values and fields.
+func expandPath(tmpl string,
+	values, fields map[string]interface{}) (string, error) {
+
+	var buf bytes.Buffer
+	for {
+		i := strings.IndexByte(tmpl, '{')
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(tmpl[i:], '}')
+		if j < 0 {
+			return "", fmt.Errorf("invalid path template %s", tmpl)
+		}
+		name, segments := tmpl[i+1:i+j], "*"
+		if k := strings.IndexByte(name, '='); k >= 0 {
+			name, segments = name[:k], name[k+1:]
+		}
+		path := strings.Split(name, ".")
+		v, ok := takeField(values, path)
+		if !ok || v == nil {
+			return "", fmt.Errorf("path variable %s is not set", name)
+		}
+		takeField(fields, path)
+		buf.WriteString(tmpl[:i])
+		buf.WriteString(escapePath(fmt.Sprint(v), segments))
+		tmpl = tmpl[i+j+1:]
+	}
+	buf.WriteString(tmpl)
+	return buf.String(), nil
+}
+
+// escapePath escapes the value of a path variable, the slashes are kept if
+// the variable matches several segments, e.g. {name=shelves/*}.
+func escapePath(v, segments string) string {
+	if segments == "*" {
+		return url.PathEscape(v)
+	}
+	parts := strings.Split(v, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+// takeField removes the field of path from fields and returns it.
+func takeField(fields map[string]interface{}, path []string) (interface{}, bool) {
+	v, ok := fields[path[0]]
+	if !ok {
+		return nil, false
+	}
+	if len(path) == 1 {
+		delete(fields, path[0])
+		return v, true
+	}
+	sub, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	v, ok = takeField(sub, path[1:])
+	if len(sub) == 0 {
+		delete(fields, path[0])
+	}
+	return v, ok
+}
+
+// queryValues flattens fields into query parameters, e.g. a.b=1&c=x&c=y.
+func queryValues(fields map[string]interface{}) url.Values {
+	q := url.Values{}
+	var add func(key string, v interface{})
+	add = func(key string, v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, f := range v {
+				add(key+"."+k, f)
+			}
+		case []interface{}:
+			for _, e := range v {
+				add(key, e)
+			}
+		case nil:
+		default:
+			q.Add(key, fmt.Sprint(v))
+		}
+	}
+	for k, v := range fields {
+		add(k, v)
+	}
+	return q
+}
@@ -0,0 +1,442 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/grpc-ecosystem/grpc-gateway/protoc-gen-grpc-gateway/httprule"
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/grpc"
+
+	"github.com/tddhit/box/transport/option"
+)
+
+type book struct {
+	Id    int64  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Title string `protobuf:"bytes,2,opt,name=title,proto3" json:"title,omitempty"`
+}
+
+func (m *book) Reset()         { *m = book{} }
+func (m *book) String() string { return proto.CompactTextString(m) }
+func (*book) ProtoMessage()    {}
+
+type shelf struct {
+	Name  string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Id    int64    `protobuf:"varint,2,opt,name=id,proto3" json:"id,omitempty"`
+	Theme string   `protobuf:"bytes,3,opt,name=theme,proto3" json:"theme,omitempty"`
+	Book  *book    `protobuf:"bytes,4,opt,name=book,proto3" json:"book,omitempty"`
+	Tags  []string `protobuf:"bytes,5,rep,name=tags,proto3" json:"tags,omitempty"`
+}
+
+func (m *shelf) Reset()         { *m = shelf{} }
+func (m *shelf) String() string { return proto.CompactTextString(m) }
+func (*shelf) ProtoMessage()    {}
+
+func newRule(method, path, body, responseBody string) Rule {
+	tmpl, err := httprule.Parse(path)
+	if err != nil {
+		panic(err)
+	}
+	t := tmpl.Compile()
+	return Rule{
+		HTTPRule: option.HTTPRule{
+			Method:       method,
+			Path:         path,
+			Body:         body,
+			ResponseBody: responseBody,
+		},
+		Pattern: runtime.MustPattern(
+			runtime.NewPattern(t.Version, t.OpCodes, t.Pool, t.Verb)),
+	}
+}
+
+func TestBind(t *testing.T) {
+	tests := []struct {
+		rule   option.HTTPRule
+		body   string
+		query  string
+		params map[string]string
+		want   *shelf
+		err    bool
+	}{
+		// the whole message, the query string is ignored.
+		{
+			rule:  option.HTTPRule{Body: "*"},
+			body:  `{"name":"shelves/a","id":"3"}`,
+			query: "theme=red",
+			want:  &shelf{Name: "shelves/a", Id: 3},
+		},
+		{
+			rule:   option.HTTPRule{Body: "*"},
+			params: map[string]string{"name": "shelves/b"},
+			want:   &shelf{Name: "shelves/b"},
+		},
+		// the path variables and the query string.
+		{
+			query:  "theme=red&tags=a&tags=b&book.title=t",
+			params: map[string]string{"id": "7"},
+			want: &shelf{Id: 7, Theme: "red", Tags: []string{"a", "b"},
+				Book: &book{Title: "t"}},
+		},
+		// the query string never overrides a path variable.
+		{
+			query:  "id=9",
+			params: map[string]string{"id": "7"},
+			want:   &shelf{Id: 7},
+		},
+		{
+			params: map[string]string{"book.id": "4", "name": "shelves/a"},
+			want:   &shelf{Name: "shelves/a", Book: &book{Id: 4}},
+		},
+		// nor the body field.
+		{
+			rule:   option.HTTPRule{Body: "book"},
+			body:   `{"id":"2","title":"t"}`,
+			query:  "book.title=x&theme=red",
+			params: map[string]string{"id": "1"},
+			want:   &shelf{Id: 1, Theme: "red", Book: &book{Id: 2, Title: "t"}},
+		},
+		{rule: option.HTTPRule{Body: "*"}, body: `{"id":`, err: true},
+		{rule: option.HTTPRule{Body: "nope"}, body: `{}`, err: true},
+		{params: map[string]string{"id": "x"}, err: true},
+	}
+	marshaler := &runtime.JSONPb{OrigName: true}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/?"+tt.query,
+			strings.NewReader(tt.body))
+		got := &shelf{}
+		err := bind(got, &Rule{HTTPRule: tt.rule}, marshaler, req, tt.params)
+		if tt.err {
+			if err == nil {
+				t.Errorf("bind(%+v, %q) = %s, want an error", tt.rule, tt.body, got)
+			}
+			continue
+		}
+		if err != nil || !proto.Equal(got, tt.want) {
+			t.Errorf("bind(%+v, %q, %q, %v) = %s, %v, want %s",
+				tt.rule, tt.body, tt.query, tt.params, got, err, tt.want)
+		}
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	tests := []struct {
+		tmpl   string
+		values string
+		fields string
+		want   string
+		left   string
+		err    bool
+	}{
+		{
+			tmpl:   "/v1/{name=shelves/*}",
+			values: `{"name":"shelves/a b","id":"1"}`,
+			fields: `{"name":"shelves/a b","id":"1"}`,
+			want:   "/v1/shelves/a%20b",
+			left:   `{"id":"1"}`,
+		},
+		{
+			tmpl:   "/v1/{name}",
+			values: `{"name":"a/b"}`,
+			want:   "/v1/a%2Fb",
+		},
+		// a custom verb, with a default value.
+		{
+			tmpl:   "/v1/shelves/{id}:publish",
+			values: `{"id":"0","theme":""}`,
+			want:   "/v1/shelves/0:publish",
+		},
+		{
+			tmpl:   "/v1/shelves/{id}/books/{book.id}",
+			values: `{"id":"1","book":{"id":"2","title":"t"}}`,
+			fields: `{"id":"1","book":{"id":"2","title":"t"}}`,
+			want:   "/v1/shelves/1/books/2",
+			left:   `{"book":{"title":"t"}}`,
+		},
+		{
+			tmpl:   "/v1/books/{book.id}",
+			values: `{"book":{"id":"2"}}`,
+			fields: `{"book":{"id":"2"}}`,
+			want:   "/v1/books/2",
+			left:   `{}`,
+		},
+		{tmpl: "/v1/shelves", values: `{"id":"1"}`, want: "/v1/shelves"},
+		{tmpl: "/v1/{id}", values: `{}`, err: true},
+		{tmpl: "/v1/{book.id}", values: `{"book":null}`, err: true},
+		{tmpl: "/v1/{id", values: `{"id":"1"}`, err: true},
+	}
+	for _, tt := range tests {
+		values, fields := decodeFields(t, tt.values), decodeFields(t, tt.fields)
+		got, err := expandPath(tt.tmpl, values, fields)
+		if tt.err {
+			if err == nil {
+				t.Errorf("expandPath(%s, %s) = %s, want an error",
+					tt.tmpl, tt.values, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("expandPath(%s, %s) = %s, %v, want %s",
+				tt.tmpl, tt.values, got, err, tt.want)
+		}
+		if left := decodeFields(t, tt.left); !reflect.DeepEqual(fields, left) {
+			t.Errorf("expandPath(%s) left %v, want %v", tt.tmpl, fields, left)
+		}
+	}
+}
+
+func decodeFields(t *testing.T, s string) map[string]interface{} {
+	if s == "" {
+		return nil
+	}
+	var fields map[string]interface{}
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+	if err := d.Decode(&fields); err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+func TestEscapePath(t *testing.T) {
+	tests := []struct {
+		v, segments, want string
+	}{
+		{"a", "*", "a"},
+		{"a/b", "*", "a%2Fb"},
+		{"a b?", "*", "a%20b%3F"},
+		{"shelves/a b", "shelves/*", "shelves/a%20b"},
+		{"shelves/a/books/b", "shelves/*/books/*", "shelves/a/books/b"},
+		{"x/y?z", "**", "x/y%3Fz"},
+		{"", "*", ""},
+	}
+	for _, tt := range tests {
+		if got := escapePath(tt.v, tt.segments); got != tt.want {
+			t.Errorf("escapePath(%q, %q) = %q, want %q",
+				tt.v, tt.segments, got, tt.want)
+		}
+	}
+}
+
+func TestTakeField(t *testing.T) {
+	tests := []struct {
+		fields string
+		path   string
+		want   interface{}
+		ok     bool
+		left   string
+	}{
+		{`{"a":"1","b":"2"}`, "a", "1", true, `{"b":"2"}`},
+		{`{"a":{"b":"1","c":"2"}}`, "a.b", "1", true, `{"a":{"c":"2"}}`},
+		// an emptied message is removed as well.
+		{`{"a":{"b":{"c":"1"}}}`, "a.b.c", "1", true, `{}`},
+		{`{"a":null}`, "a", nil, true, `{}`},
+		{`{"a":"1"}`, "b", nil, false, `{"a":"1"}`},
+		{`{"a":"1"}`, "a.b", nil, false, `{"a":"1"}`},
+		{`{"a":{"c":"1"}}`, "a.b", nil, false, `{"a":{"c":"1"}}`},
+	}
+	for _, tt := range tests {
+		fields := decodeFields(t, tt.fields)
+		v, ok := takeField(fields, strings.Split(tt.path, "."))
+		if v != tt.want || ok != tt.ok {
+			t.Errorf("takeField(%s, %s) = %v, %v, want %v, %v",
+				tt.fields, tt.path, v, ok, tt.want, tt.ok)
+		}
+		if left := decodeFields(t, tt.left); !reflect.DeepEqual(fields, left) {
+			t.Errorf("takeField(%s, %s) left %v, want %v",
+				tt.fields, tt.path, fields, left)
+		}
+	}
+	if _, ok := takeField(nil, []string{"a"}); ok {
+		t.Error("takeField(nil) found a field")
+	}
+}
+
+func TestQueryValues(t *testing.T) {
+	tests := []struct {
+		fields string
+		want   string
+	}{
+		{`{}`, ""},
+		{`{"a":"x y","b":1,"c":true}`, "a=x+y&b=1&c=true"},
+		{`{"a":{"b":{"c":"1"},"d":"2"}}`, "a.b.c=1&a.d=2"},
+		{`{"tags":["x","y"]}`, "tags=x&tags=y"},
+		{`{"a":null,"b":[],"c":1.5}`, "c=1.5"},
+	}
+	for _, tt := range tests {
+		if got := queryValues(decodeFields(t, tt.fields)).Encode(); got != tt.want {
+			t.Errorf("queryValues(%s) = %s, want %s", tt.fields, got, tt.want)
+		}
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+	tests := []struct {
+		rule option.HTTPRule
+		msg  *shelf
+		url  string
+		body string
+		err  bool
+	}{
+		{
+			rule: option.HTTPRule{Method: "POST", Path: "/v1/{name=shelves/*}:publish", Body: "*"},
+			msg:  &shelf{Name: "shelves/a", Theme: "red"},
+			url:  "http://h/v1/shelves/a:publish",
+			body: `{"name":"shelves/a","theme":"red"}`,
+		},
+		// a path variable may be 0, the defaults are not in the query.
+		{
+			rule: option.HTTPRule{Method: "GET", Path: "/v1/shelves/{id}"},
+			msg:  &shelf{Theme: "red", Tags: []string{"a", "b"}},
+			url:  "http://h/v1/shelves/0?tags=a&tags=b&theme=red",
+		},
+		{
+			rule: option.HTTPRule{Method: "GET", Path: "/v1/shelves"},
+			msg:  &shelf{Id: 1},
+			url:  "http://h/v1/shelves?id=1",
+		},
+		{
+			rule: option.HTTPRule{Method: "PATCH", Path: "/v1/shelves/{id}/books/{book.id}", Body: "book"},
+			msg:  &shelf{Id: 1, Theme: "red", Book: &book{Title: "t"}},
+			url:  "http://h/v1/shelves/1/books/0?theme=red",
+			body: `{"title":"t"}`,
+		},
+		{
+			rule: option.HTTPRule{Method: "LIST", Path: "/v1/{name}"},
+			msg:  &shelf{Name: "a/b", Book: &book{Id: 2}},
+			url:  "http://h/v1/a%2Fb?book.id=2",
+		},
+		{
+			rule: option.HTTPRule{Method: "GET", Path: "/v1/books/{book.id}"},
+			msg:  &shelf{},
+			err:  true,
+		},
+	}
+	c := &HttpClient{scheme: "http", addr: "h",
+		marshaler: &jsonpb.Marshaler{EnumsAsInts: true}}
+	for _, tt := range tests {
+		req, err := c.newRequest(context.Background(), &tt.rule, tt.msg)
+		if tt.err {
+			if err == nil {
+				t.Errorf("newRequest(%+v, %s) = %s, want an error",
+					tt.rule, tt.msg, req.URL)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newRequest(%+v, %s): %v", tt.rule, tt.msg, err)
+			continue
+		}
+		var body []byte
+		if req.Body != nil {
+			body, _ = ioutil.ReadAll(req.Body)
+		}
+		if req.Method != tt.rule.Method || req.URL.String() != tt.url ||
+			string(body) != tt.body {
+
+			t.Errorf("newRequest(%+v, %s) = %s %s %s, want %s %s",
+				tt.rule, tt.msg, req.Method, req.URL, body, tt.url, tt.body)
+		}
+	}
+}
+
+type library interface {
+	GetShelf(context.Context, *shelf) (*shelf, error)
+	UpdateBook(context.Context, *shelf) (*shelf, error)
+}
+
+// echoLibrary replies the request, so that the tests see what was bound.
+type echoLibrary struct{}
+
+func (echoLibrary) GetShelf(ctx context.Context, in *shelf) (*shelf, error) {
+	return in, nil
+}
+
+func (echoLibrary) UpdateBook(ctx context.Context, in *shelf) (*shelf, error) {
+	return in, nil
+}
+
+type httpDesc struct {
+	desc *ServiceDesc
+}
+
+func (d httpDesc) Desc() interface{} {
+	return d.desc
+}
+
+func TestRuleRoundTrip(t *testing.T) {
+	getShelf := []Rule{
+		newRule("GET", "/v1/{name=shelves/*}", "", ""),
+		// additional_bindings.
+		newRule("GET", "/v1/shelves/{id}:get", "", ""),
+		newRule("LIST", "/v1/shelves", "", ""),
+	}
+	updateBook := []Rule{
+		newRule("PATCH", "/v1/shelves/{id}/books/{book.id}", "book", "book"),
+	}
+	sd := &ServiceDesc{
+		ServiceDesc: &grpc.ServiceDesc{
+			ServiceName: "test.Library",
+			HandlerType: (*library)(nil),
+			Methods: []grpc.MethodDesc{
+				{MethodName: "GetShelf"},
+				{MethodName: "UpdateBook"},
+			},
+		},
+		Rules: map[string][]Rule{
+			"GetShelf":   getShelf,
+			"UpdateBook": updateBook,
+		},
+	}
+	s := New(nil)
+	s.Register(httpDesc{sd}, echoLibrary{})
+	ts := httptest.NewServer(s.Server.Handler)
+	defer ts.Close()
+	c, err := DialContext(context.Background(),
+		strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rule *Rule
+		in   *shelf
+		want *shelf
+	}{
+		{&getShelf[0], &shelf{Name: "shelves/a b", Theme: "red"},
+			&shelf{Name: "shelves/a b", Theme: "red"}},
+		{&getShelf[1], &shelf{Id: 0, Tags: []string{"x", "y"}},
+			&shelf{Tags: []string{"x", "y"}}},
+		{&getShelf[2], &shelf{Id: 3, Book: &book{Title: "t"}},
+			&shelf{Id: 3, Book: &book{Title: "t"}}},
+		// only the book is replied.
+		{&updateBook[0], &shelf{Id: 1, Theme: "red", Book: &book{Id: 2, Title: "t"}},
+			&shelf{Book: &book{Id: 2, Title: "t"}}},
+	}
+	for _, tt := range tests {
+		got := &shelf{}
+		err := c.Invoke(context.Background(), "/test.Library/GetShelf", tt.in,
+			got, option.WithHTTPRule(&tt.rule.HTTPRule))
+		if err != nil || !proto.Equal(got, tt.want) {
+			t.Errorf("%s %s: got %s, %v, want %s", tt.rule.Method,
+				tt.rule.Path, got, err, tt.want)
+		}
+	}
+
+	rsp, err := http.Get(ts.URL + "/v1/shelves/x:get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("a bad path variable got %s", rsp.Status)
+	}
+}
@@ -3,14 +3,16 @@ package http
 import (
 	"context"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"reflect"
+	"sync/atomic"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/tddhit/box/interceptor"
 	"github.com/tddhit/box/transport/common"
@@ -20,14 +22,17 @@ import (
 
 type HttpServer struct {
 	*http.Server
-	mux  *runtime.ServeMux
-	lis  net.Listener
-	opts option.ServerOptions
+	mux      *runtime.ServeMux
+	lis      net.Listener
+	opts     option.ServerOptions
+	inflight int64
+	requests int64
 }
 
 type ServiceDesc struct {
 	*grpc.ServiceDesc
-	Pattern map[string]runtime.Pattern
+	Pattern map[string]runtime.Pattern // the primary pattern of a method
+	Rules   map[string][]Rule          // the bindings of a method, see rule.go
 }
 
 func New(lis net.Listener,
@@ -47,10 +52,29 @@ func New(lis net.Listener,
 	} else {
 		s.mux = runtime.NewServeMux()
 	}
-	s.Server.Handler = s.mux
+	s.Server.Handler = http.HandlerFunc(s.serveHTTP)
+	s.Server.TLSConfig = ops.TLSConfig
 	return s
 }
 
+// Serve serves TLS if the server has a TLS config.
+func (s *HttpServer) Serve(lis net.Listener) error {
+	if s.Server.TLSConfig != nil {
+		return s.Server.ServeTLS(lis, "", "")
+	}
+	return s.Server.Serve(lis)
+}
+
+func (s *HttpServer) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&s.requests, 1)
+	atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
+	if req.TLS != nil {
+		req = req.WithContext(common.NewPeerContext(req.Context(), req.TLS))
+	}
+	s.mux.ServeHTTP(w, req)
+}
+
 func (s *HttpServer) Register(desc common.ServiceDesc,
 	service interface{}) {
 
@@ -70,18 +94,22 @@ func (s *HttpServer) register(sd *ServiceDesc, handler interface{}) {
 	hv := reflect.ValueOf(handler)
 	for _, method := range sd.ServiceDesc.Methods {
 		m := method
-		handlerFunc := func(w http.ResponseWriter, req *http.Request,
-			pathParams map[string]string) {
+		for _, rule := range sd.rules(m.MethodName) {
+			r := rule
+			handlerFunc := func(w http.ResponseWriter, req *http.Request,
+				pathParams map[string]string) {
 
-			s.handlerFunc(w, req, pathParams, hv, m, sd.ServiceName)
+				s.handlerFunc(w, req, pathParams, hv, m, &r, sd.ServiceName)
+			}
+			s.mux.Handle(r.Method, r.Pattern, handlerFunc)
 		}
-		s.mux.Handle("POST", sd.Pattern[method.MethodName], handlerFunc)
 	}
 }
 
 func (s *HttpServer) handlerFunc(w http.ResponseWriter,
 	req *http.Request, pathParams map[string]string,
-	hv reflect.Value, method grpc.MethodDesc, serviceName string) {
+	hv reflect.Value, method grpc.MethodDesc, rule *Rule,
+	serviceName string) {
 
 	ctx, cancel := context.WithCancel(req.Context())
 	defer cancel()
@@ -105,7 +133,8 @@ func (s *HttpServer) handlerFunc(w http.ResponseWriter,
 	f := func(ctx context.Context, req interface{},
 		info *common.UnaryServerInfo) (interface{}, error) {
 
-		return handleReq(ctx, m, inboundMarshaler, req.(*http.Request), pathParams)
+		return handleReq(ctx, m, rule, inboundMarshaler, req.(*http.Request),
+			pathParams)
 	}
 	h := interceptor.ChainUnaryServerMiddleware(f, s.opts.UnaryMiddlewares...)
 	info := &common.UnaryServerInfo{
@@ -113,21 +142,28 @@ func (s *HttpServer) handlerFunc(w http.ResponseWriter,
 		FullMethod: fmt.Sprintf("/%s/%s", serviceName, method.MethodName),
 	}
 	resp, err := h(rctx, req, info)
+	if err != nil {
+		runtime.HTTPError(ctx, s.mux, outboundMarshaler, w, req, toStatus(err))
+		return
+	}
+	reply := resp.(proto.Message)
+	if rule.ResponseBody != "" {
+		reply = responseBody{reply, rule.ResponseBody}
+	}
 	runtime.ForwardResponseMessage(ctx, s.mux, outboundMarshaler, w,
-		req, resp.(proto.Message), s.mux.GetForwardResponseOptions()...)
+		req, reply, s.mux.GetForwardResponseOptions()...)
 }
 
-func handleReq(ctx context.Context, method reflect.Value,
+func handleReq(ctx context.Context, method reflect.Value, rule *Rule,
 	marshaler runtime.Marshaler, req *http.Request,
 	pathParams map[string]string) (proto.Message, error) {
 
 	reqType := method.Type().In(1).Elem()
 	protoReq := reflect.New(reqType).Interface().(proto.Message)
-	err := marshaler.NewDecoder(req.Body).Decode(protoReq)
-	if err != nil && err != io.EOF {
-		return nil, err
+	err := bind(protoReq, rule, marshaler, req, pathParams)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	err = nil
 	replies := method.Call([]reflect.Value{
 		reflect.ValueOf(ctx),
 		reflect.ValueOf(protoReq),
@@ -140,11 +176,31 @@ func handleReq(ctx context.Context, method reflect.Value,
 }
 
 func (s *HttpServer) Close() {
+	s.Shutdown(context.Background())
+}
+
+// Shutdown stops accepting and waits for the in-flight requests, the
+// remaining connections are closed once ctx is done.
+func (s *HttpServer) Shutdown(ctx context.Context) error {
 	if s.opts.FuncBeforeClose != nil {
 		s.opts.FuncBeforeClose()
 	}
-	s.Server.Shutdown(context.Background())
+	err := s.Server.Shutdown(ctx)
+	if err != nil {
+		s.Server.Close()
+	}
 	if s.opts.FuncAfterClose != nil {
 		s.opts.FuncAfterClose()
 	}
+	return err
+}
+
+// Inflight returns the number of requests being handled.
+func (s *HttpServer) Inflight() int64 {
+	return atomic.LoadInt64(&s.inflight)
+}
+
+// Requests returns the number of requests handled since start.
+func (s *HttpServer) Requests() int64 {
+	return atomic.LoadInt64(&s.requests)
 }
@@ -0,0 +1,101 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/golang/protobuf/jsonpb"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors are replied by runtime.HTTPError, whose body holds the status of
+// the error, i.e. {"error": "...", "code": 5, "message": "...", "details":
+// [...]}, with the HTTP status mapped from its code. The client decodes such
+// a body back into the status error, so status.Code works on the errors of
+// both transports.
+
+// maxErrorBody bounds the error body read by the client.
+const maxErrorBody = 64 << 10
+
+// toStatus converts the errors of the context to their codes as grpc does,
+// the other errors are kept.
+func toStatus(err error) error {
+	switch err {
+	case context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return err
+}
+
+// transportError returns the status error of a request which got no
+// response, Unavailable unless ctx is done or the client timed out.
+func transportError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return toStatus(ctx.Err())
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+// errorFromResponse returns the status error of a non-2xx response. A body
+// which is not a status with an error code, e.g. from a proxy, is the message
+// of an error with the code mapped from the HTTP status.
+func errorFromResponse(rsp *http.Response) error {
+	b, err := ioutil.ReadAll(io.LimitReader(rsp.Body, maxErrorBody))
+	if err != nil {
+		return status.Error(codeFromHTTPStatus(rsp.StatusCode), err.Error())
+	}
+	s := &spb.Status{}
+	u := &jsonpb.Unmarshaler{AllowUnknownFields: true}
+	if err := u.Unmarshal(bytes.NewReader(b), s); err == nil &&
+		s.Code > int32(codes.OK) && s.Code <= int32(codes.Unauthenticated) {
+
+		return status.ErrorProto(s)
+	}
+	msg := strings.TrimSpace(string(b))
+	if msg == "" {
+		msg = rsp.Status
+	}
+	return status.Error(codeFromHTTPStatus(rsp.StatusCode), msg)
+}
+
+// codeFromHTTPStatus is the inverse of runtime.HTTPStatusFromCode, an HTTP
+// status shared by several codes maps to the most general one.
+func codeFromHTTPStatus(code int) codes.Code {
+	switch code {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusRequestTimeout:
+		return codes.Canceled
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented, http.StatusMethodNotAllowed:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable, http.StatusBadGateway:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusInternalServerError:
+		return codes.Internal
+	}
+	return codes.Unknown
+}
@@ -0,0 +1,162 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCodeFromHTTPStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   codes.Code
+	}{
+		{http.StatusBadRequest, codes.InvalidArgument},
+		{http.StatusUnauthorized, codes.Unauthenticated},
+		{http.StatusForbidden, codes.PermissionDenied},
+		{http.StatusNotFound, codes.NotFound},
+		{http.StatusRequestTimeout, codes.Canceled},
+		{http.StatusConflict, codes.AlreadyExists},
+		{http.StatusTooManyRequests, codes.ResourceExhausted},
+		{http.StatusNotImplemented, codes.Unimplemented},
+		{http.StatusMethodNotAllowed, codes.Unimplemented},
+		{http.StatusServiceUnavailable, codes.Unavailable},
+		{http.StatusBadGateway, codes.Unavailable},
+		{http.StatusGatewayTimeout, codes.DeadlineExceeded},
+		{http.StatusInternalServerError, codes.Internal},
+		{http.StatusTeapot, codes.Unknown},
+		{http.StatusFound, codes.Unknown},
+	}
+	for _, tt := range tests {
+		if got := codeFromHTTPStatus(tt.status); got != tt.want {
+			t.Errorf("codeFromHTTPStatus(%d) = %s, want %s",
+				tt.status, got, tt.want)
+		}
+	}
+	// the inverse of runtime.HTTPStatusFromCode for the codes whose HTTP
+	// status is their own.
+	for _, c := range []codes.Code{codes.InvalidArgument, codes.Unauthenticated,
+		codes.PermissionDenied, codes.NotFound, codes.Canceled,
+		codes.AlreadyExists, codes.ResourceExhausted, codes.Unimplemented,
+		codes.Unavailable, codes.DeadlineExceeded, codes.Internal} {
+
+		if got := codeFromHTTPStatus(runtime.HTTPStatusFromCode(c)); got != c {
+			t.Errorf("codeFromHTTPStatus(HTTPStatusFromCode(%s)) = %s", c, got)
+		}
+	}
+}
+
+func TestErrorRoundTrip(t *testing.T) {
+	withDetails, err := status.New(codes.InvalidArgument, "bad shelf").
+		WithDetails(&errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: "name", Description: "empty"},
+			},
+		}, &errdetails.ErrorInfo{Reason: "EMPTY", Domain: "box"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []*status.Status{
+		status.New(codes.NotFound, "no such shelf"),
+		status.New(codes.Unauthenticated, ""),
+		status.New(codes.Internal, "a \"quoted\" message"),
+		withDetails,
+	}
+	mux := runtime.NewServeMux()
+	for _, want := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		_, marshaler := runtime.MarshalerForRequest(mux, req)
+		runtime.HTTPError(context.Background(), mux, marshaler, w, req,
+			want.Err())
+		rsp := w.Result()
+		if rsp.StatusCode != runtime.HTTPStatusFromCode(want.Code()) {
+			t.Errorf("%s: got HTTP %d", want.Code(), rsp.StatusCode)
+		}
+		got, ok := status.FromError(errorFromResponse(rsp))
+		if !ok || !proto.Equal(got.Proto(), want.Proto()) {
+			t.Errorf("errorFromResponse(%s) = %v, want %v",
+				want.Code(), got.Proto(), want.Proto())
+		}
+	}
+}
+
+func TestErrorFromResponse(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		code   codes.Code
+		msg    string
+	}{
+		{http.StatusNotFound, `{"code": 5, "message": "gone"}`, codes.NotFound, "gone"},
+		{http.StatusBadGateway, "upstream down\n", codes.Unavailable, "upstream down"},
+		{http.StatusGatewayTimeout, "", codes.DeadlineExceeded, "504 Gateway Timeout"},
+		// JSON which is not a status with an error code.
+		{http.StatusBadRequest, `{"code": 0, "message": "ok"}`, codes.InvalidArgument,
+			`{"code": 0, "message": "ok"}`},
+		{http.StatusInternalServerError, `{"code": 500}`, codes.Internal, `{"code": 500}`},
+		{http.StatusInternalServerError, `{"code": -1}`, codes.Internal, `{"code": -1}`},
+		{http.StatusForbidden, `{"error": "denied"}`, codes.PermissionDenied,
+			`{"error": "denied"}`},
+		{http.StatusTeapot, `[1, 2]`, codes.Unknown, `[1, 2]`},
+	}
+	for _, tt := range tests {
+		rsp := &http.Response{
+			StatusCode: tt.status,
+			Status:     fmt.Sprintf("%d %s", tt.status, http.StatusText(tt.status)),
+			Body:       ioutil.NopCloser(strings.NewReader(tt.body)),
+		}
+		s, _ := status.FromError(errorFromResponse(rsp))
+		if s.Code() != tt.code || s.Message() != tt.msg {
+			t.Errorf("errorFromResponse(%d, %q) = %s %q, want %s %q",
+				tt.status, tt.body, s.Code(), s.Message(), tt.code, tt.msg)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTransportError(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), -1)
+	defer cancel()
+	var _ net.Error = timeoutError{}
+
+	tests := []struct {
+		ctx  context.Context
+		err  error
+		code codes.Code
+	}{
+		{context.Background(), errors.New("connection refused"), codes.Unavailable},
+		{context.Background(), timeoutError{}, codes.DeadlineExceeded},
+		{context.Background(), &net.OpError{Op: "dial", Err: timeoutError{}},
+			codes.DeadlineExceeded},
+		// ctx wins over the error it caused.
+		{canceled, errors.New("connection reset"), codes.Canceled},
+		{canceled, timeoutError{}, codes.Canceled},
+		{expired, errors.New("connection reset"), codes.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		if got := status.Code(transportError(tt.ctx, tt.err)); got != tt.code {
+			t.Errorf("transportError(%v, %v) = %s, want %s",
+				tt.ctx.Err(), tt.err, got, tt.code)
+		}
+	}
+}
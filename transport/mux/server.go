@@ -0,0 +1,267 @@
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/tddhit/box/transport/common"
+	grpctr "github.com/tddhit/box/transport/grpc"
+	httptr "github.com/tddhit/box/transport/http"
+	"github.com/tddhit/box/transport/option"
+	"github.com/tddhit/tools/log"
+)
+
+// sniffTimeout bounds the wait for the first bytes of a connection.
+const sniffTimeout = 10 * time.Second
+
+var (
+	errListenerClosed = errors.New("mux: listener closed")
+
+	// the HTTP/2 client connection preface, grpc never sends HTTP/1.1.
+	preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+)
+
+// MuxTransport serves grpc and http on one listener. A connection starting
+// with the HTTP/2 client preface goes to the grpc server, any other one to
+// the http server, which serves HTTP/1.1 and the gateway.
+type MuxTransport struct {
+	grpc    *grpctr.GrpcTransport
+	http    *httptr.HttpServer
+	opts    option.ServerOptions
+	lis     net.Listener
+	grpcLis *connListener
+	httpLis *connListener
+	closing int32
+}
+
+func New(lis net.Listener,
+	opts ...option.ServerOption) *MuxTransport {
+
+	var ops option.ServerOptions
+	for _, o := range opts {
+		o(&ops)
+	}
+	// the close funcs run once for both servers, see Shutdown.
+	opts = append(opts, option.WithBeforeClose(nil),
+		option.WithAfterClose(nil))
+	return &MuxTransport{
+		grpc:    grpctr.New(lis, opts...),
+		http:    httptr.New(lis, opts...),
+		opts:    ops,
+		lis:     lis,
+		grpcLis: newConnListener(lis.Addr()),
+		httpLis: newConnListener(lis.Addr()),
+	}
+}
+
+// Register registers service to the grpc server, and to the http server if
+// desc is an http ServiceDesc, whose methods are the grpc ones.
+func (s *MuxTransport) Register(desc common.ServiceDesc,
+	service interface{}) {
+
+	if sd, ok := desc.Desc().(*httptr.ServiceDesc); ok {
+		s.grpc.Register(grpcDesc{sd.ServiceDesc}, service)
+		s.http.Register(desc, service)
+		return
+	}
+	s.grpc.Register(desc, service)
+}
+
+type grpcDesc struct {
+	desc *grpc.ServiceDesc
+}
+
+func (d grpcDesc) Desc() interface{} {
+	return d.desc
+}
+
+// Serve accepts the connections of lis and hands them over to the grpc and
+// http servers, until Shutdown. If either server stops serving before, the
+// other one and the accept loop are stopped as well and its error returned.
+func (s *MuxTransport) Serve(lis net.Listener) error {
+	errC := make(chan error, 3)
+	go func() {
+		errC <- s.grpc.Serve(s.grpcLis)
+	}()
+	go func() {
+		errC <- s.http.Serve(s.httpLis)
+	}()
+	go func() {
+		errC <- s.accept(lis)
+	}()
+	err := <-errC
+	if atomic.LoadInt32(&s.closing) == 1 {
+		return nil
+	}
+	lis.Close()
+	s.grpcLis.Close()
+	s.httpLis.Close()
+	return err
+}
+
+func (s *MuxTransport) accept(lis net.Listener) error {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&s.closing) == 1 {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.dispatch(conn)
+	}
+}
+
+func (s *MuxTransport) dispatch(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	br := bufio.NewReader(conn)
+	h2, err := isHTTP2(br)
+	if err != nil {
+		log.Debug("mux sniff:", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	l := s.httpLis
+	if h2 {
+		l = s.grpcLis
+	}
+	l.deliver(&sniffedConn{Conn: conn, r: br})
+}
+
+// isHTTP2 reports whether the connection starts with the HTTP/2 preface. It
+// reads no more than needed to tell, since an http request may be shorter.
+func isHTTP2(br *bufio.Reader) (bool, error) {
+	for n := 1; n <= len(preface); n++ {
+		b, err := br.Peek(n)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(b, preface[:n]) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (s *MuxTransport) Close() {
+	s.Shutdown(context.Background())
+}
+
+// Shutdown stops accepting and shuts down both servers concurrently.
+func (s *MuxTransport) Shutdown(ctx context.Context) error {
+	if s.opts.FuncBeforeClose != nil {
+		s.opts.FuncBeforeClose()
+	}
+	atomic.StoreInt32(&s.closing, 1)
+	s.lis.Close()
+	var (
+		wg      sync.WaitGroup
+		grpcErr error
+		httpErr error
+	)
+	wg.Add(2)
+	go func() {
+		grpcErr = s.grpc.Shutdown(ctx)
+		wg.Done()
+	}()
+	go func() {
+		httpErr = s.http.Shutdown(ctx)
+		wg.Done()
+	}()
+	wg.Wait()
+	if s.opts.FuncAfterClose != nil {
+		s.opts.FuncAfterClose()
+	}
+	if grpcErr != nil {
+		return grpcErr
+	}
+	return httpErr
+}
+
+// Inflight returns the number of rpcs and requests being handled.
+func (s *MuxTransport) Inflight() int64 {
+	return s.grpc.Inflight() + s.http.Inflight()
+}
+
+// Requests returns the number of rpcs and requests handled since start.
+func (s *MuxTransport) Requests() int64 {
+	return s.grpc.Requests() + s.http.Requests()
+}
+
+// GrpcTransport returns the grpc server, e.g. to register a service by its
+// generated grpc register func.
+func (s *MuxTransport) GrpcTransport() *grpctr.GrpcTransport {
+	return s.grpc
+}
+
+// HttpServer returns the http server.
+func (s *MuxTransport) HttpServer() *httptr.HttpServer {
+	return s.http
+}
+
+// sniffedConn reads the bytes peeked by isHTTP2 first.
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// connListener is the listener of one server, fed by dispatch.
+type connListener struct {
+	addr   net.Addr
+	connC  chan net.Conn
+	closeC chan struct{}
+	once   sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		connC:  make(chan net.Conn),
+		closeC: make(chan struct{}),
+	}
+}
+
+func (l *connListener) deliver(conn net.Conn) {
+	select {
+	case l.connC <- conn:
+	case <-l.closeC:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connC:
+		return conn, nil
+	case <-l.closeC:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.closeC)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,105 @@
+package mux
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T) (*MuxTransport, net.Listener, chan error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(lis)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.Serve(lis)
+	}()
+	return s, lis, errC
+}
+
+func wait(t *testing.T, errC chan error) error {
+	select {
+	case err := <-errC:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+	return nil
+}
+
+func TestMuxDispatch(t *testing.T) {
+	s, lis, errC := listen(t)
+
+	// grpc answers the preface with its SETTINGS frame.
+	c, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write(append(preface, 0, 0, 0, 4, 0, 0, 0, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, 9)
+	if _, err := io.ReadFull(c, frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame[3] != 0x4 {
+		t.Fatalf("got frame type %d, want SETTINGS", frame[3])
+	}
+	c.Close()
+
+	// http answers an HTTP/1.1 request on the same listener, a short one
+	// is not taken for a truncated preface.
+	for _, req := range []string{
+		"GET /nowhere HTTP/1.1\r\nHost: mux\r\n\r\n",
+		"PUT / HTTP/1.1\r\nHost: mux\r\nContent-Length: 0\r\n\r\n",
+	} {
+		c, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(c, req); err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatalf("%q: %v", req, err)
+		}
+		rsp.Body.Close()
+		c.Close()
+		if rsp.ProtoMajor != 1 || rsp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%q: got %s %s", req, rsp.Proto, rsp.Status)
+		}
+	}
+	if n := s.Requests(); n != 2 {
+		t.Fatalf("Requests() = %d, want 2", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.Shutdown(ctx)
+	if err := wait(t, errC); err != nil {
+		t.Fatalf("Serve after Shutdown = %v", err)
+	}
+}
+
+func TestMuxServeError(t *testing.T) {
+	s, lis, errC := listen(t)
+	// the http server stops serving on its own.
+	s.httpLis.Close()
+	if err := wait(t, errC); err != errListenerClosed {
+		t.Fatalf("Serve = %v, want %v", err, errListenerClosed)
+	}
+	// and takes the listener down with it.
+	if c, err := net.DialTimeout("tcp", lis.Addr().String(), time.Second); err == nil {
+		c.Close()
+		t.Fatal("listener still open")
+	}
+}
@@ -1,6 +1,9 @@
 package option
 
 import (
+	"crypto/tls"
+	"os"
+
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 
 	"github.com/tddhit/box/interceptor"
@@ -15,6 +18,15 @@ type ServerOptions struct {
 	StreamMiddlewares []interceptor.StreamServerMiddleware
 	FuncBeforeClose   func()
 	FuncAfterClose    func()
+
+	// TLS, see tls.go
+	TLSCert   string
+	TLSKey    string
+	ClientCA  string
+	TLSConfig *tls.Config
+
+	// permissions of the socket file of a +unix target
+	SocketMode os.FileMode
 }
 
 type ServerOption func(*ServerOptions)
@@ -58,10 +70,49 @@ func WithAfterClose(f func()) ServerOption {
 	}
 }
 
+// WithTLS serves TLS with the PEM certificate and key files, which are
+// reloaded when they change. It requires a grpcs:// or https:// target.
+func WithTLS(certFile, keyFile string) ServerOption {
+	return func(o *ServerOptions) {
+		o.TLSCert = certFile
+		o.TLSKey = keyFile
+	}
+}
+
+// WithClientCA requires client certificates signed by a CA of the PEM file,
+// i.e. mutual TLS.
+func WithClientCA(caFile string) ServerOption {
+	return func(o *ServerOptions) {
+		o.ClientCA = caFile
+	}
+}
+
+// WithServerTLSConfig serves TLS with c instead of the files of WithTLS.
+func WithServerTLSConfig(c *tls.Config) ServerOption {
+	return func(o *ServerOptions) {
+		o.TLSConfig = c
+	}
+}
+
+// WithSocketMode sets the permissions of the socket file of a grpc+unix:// or
+// http+unix:// target, which otherwise follow the umask.
+func WithSocketMode(mode os.FileMode) ServerOption {
+	return func(o *ServerOptions) {
+		o.SocketMode = mode
+	}
+}
+
 type DialOptions struct {
 	Balancer          string
 	UnaryMiddlewares  []interceptor.UnaryClientMiddleware
 	StreamMiddlewares []interceptor.StreamClientMiddleware
+
+	// TLS, see tls.go
+	TLSConfig  *tls.Config
+	ServerName string
+	RootCA     string
+	ClientCert string
+	ClientKey  string
 }
 
 type DialOption func(*DialOptions)
@@ -84,7 +135,58 @@ func WithBalancer(b string) DialOption {
 	}
 }
 
+// WithTLSConfig dials TLS with a copy of c, which the other TLS dial options
+// modify.
+func WithTLSConfig(c *tls.Config) DialOption {
+	return func(o *DialOptions) {
+		o.TLSConfig = c
+	}
+}
+
+// WithServerName sets the name the server certificate is verified against.
+func WithServerName(name string) DialOption {
+	return func(o *DialOptions) {
+		o.ServerName = name
+	}
+}
+
+// WithRootCA verifies the server certificate with the CAs of the PEM file
+// instead of the system ones.
+func WithRootCA(caFile string) DialOption {
+	return func(o *DialOptions) {
+		o.RootCA = caFile
+	}
+}
+
+// WithClientCert presents the PEM certificate and key files to servers
+// requiring mutual TLS, they are reloaded when they change.
+func WithClientCert(certFile, keyFile string) DialOption {
+	return func(o *DialOptions) {
+		o.ClientCert = certFile
+		o.ClientKey = keyFile
+	}
+}
+
 type CallOptions struct {
+	HTTPRule *HTTPRule
 }
 
 type CallOption func(*CallOptions)
+
+// HTTPRule is a google.api.http binding of a method, see
+// google/api/http.proto.
+type HTTPRule struct {
+	Method       string // GET, PUT, POST, DELETE, PATCH or a custom verb
+	Path         string // path template, e.g. /v1/{name=shelves/*}:get
+	Body         string // "*", a field name, or empty for no body
+	ResponseBody string // a field name, or empty for the whole reply
+}
+
+// WithHTTPRule makes the http client send the request as rule, instead of
+// POSTing the whole message to the method path. It is set by the generated
+// http clients.
+func WithHTTPRule(rule *HTTPRule) CallOption {
+	return func(o *CallOptions) {
+		o.HTTPRule = rule
+	}
+}
@@ -0,0 +1,163 @@
+package option
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tddhit/tools/log"
+)
+
+// The certificate, key and CA files are checked at most once per
+// reloadInterval during handshakes, and loaded again once they changed. The
+// established connections keep the old certificate, so a certificate can be
+// renewed without dropping them.
+
+const reloadInterval = time.Second
+
+var errNoCA = errors.New("no certificate found in CA file")
+
+// ServerTLSConfig returns the TLS config of the server, or nil if TLS is not
+// set. nextProtos are the ALPN protocols of the transport.
+func (o *ServerOptions) ServerTLSConfig(nextProtos ...string) (*tls.Config, error) {
+	if o.TLSConfig != nil {
+		return o.TLSConfig, nil
+	}
+	if o.TLSCert == "" {
+		return nil, nil
+	}
+	r := &tlsFiles{cert: o.TLSCert, key: o.TLSKey, ca: o.ClientCA}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.get()
+			return cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.get()
+			c := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   nextProtos,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if pool != nil {
+				c.ClientCAs = pool
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return c, nil
+		},
+	}, nil
+}
+
+// UseTLS reports whether a TLS dial option is set.
+func (o *DialOptions) UseTLS() bool {
+	return o.TLSConfig != nil || o.ServerName != "" || o.ClientCert != "" ||
+		o.RootCA != ""
+}
+
+// ClientTLSConfig returns the TLS config of the client built on TLSConfig.
+func (o *DialOptions) ClientTLSConfig() (*tls.Config, error) {
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.TLSConfig != nil {
+		c = o.TLSConfig.Clone()
+	}
+	if o.ServerName != "" {
+		c.ServerName = o.ServerName
+	}
+	if o.RootCA != "" {
+		pool, err := loadCA(o.RootCA)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = pool
+	}
+	if o.ClientCert != "" {
+		r := &tlsFiles{cert: o.ClientCert, key: o.ClientKey}
+		if err := r.load(); err != nil {
+			return nil, err
+		}
+		c.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.get()
+			return cert, nil
+		}
+	}
+	return c, nil
+}
+
+// tlsFiles keeps a certificate and an optional CA pool loaded from files.
+type tlsFiles struct {
+	cert, key, ca string
+
+	mu      sync.Mutex
+	checked time.Time
+	mtime   time.Time // the latest of the files
+	pair    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+func (r *tlsFiles) load() error {
+	mtime := r.modTime()
+	pair, err := tls.LoadX509KeyPair(r.cert, r.key)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.ca != "" {
+		if pool, err = loadCA(r.ca); err != nil {
+			return err
+		}
+	}
+	r.pair, r.pool, r.mtime = &pair, pool, mtime
+	return nil
+}
+
+// get returns the current certificate and CA pool, reloading them if the
+// files changed. A failed reload keeps the old ones.
+func (r *tlsFiles) get() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now := time.Now(); now.Sub(r.checked) >= reloadInterval {
+		r.checked = now
+		if r.modTime().After(r.mtime) {
+			if err := r.load(); err != nil {
+				log.Errorf("TLSReload\tCert=%s\tErr=%s\n", r.cert, err.Error())
+			} else {
+				log.Infof("TLSReload\tCert=%s\n", r.cert)
+			}
+		}
+	}
+	return r.pair, r.pool
+}
+
+func (r *tlsFiles) modTime() (t time.Time) {
+	for _, path := range []string{r.cert, r.key, r.ca} {
+		if path == "" {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return
+}
+
+func loadCA(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errNoCA
+	}
+	return pool, nil
+}
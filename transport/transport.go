@@ -2,17 +2,17 @@ package transport
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"net"
-	"os"
 	"strings"
 	"time"
 
-	mwcommon "github.com/tddhit/box/mw/common"
 	"github.com/tddhit/box/socket"
 	trcommon "github.com/tddhit/box/transport/common"
 	grpctr "github.com/tddhit/box/transport/grpc"
 	httptr "github.com/tddhit/box/transport/http"
+	muxtr "github.com/tddhit/box/transport/mux"
 	"github.com/tddhit/box/transport/option"
 	"github.com/tddhit/box/util"
 	"github.com/tddhit/tools/log"
@@ -20,45 +20,79 @@ import (
 
 var (
 	errInvalidListenTarget = errors.New(`
-Invalid listen target. e.g. [grpc | http]://[127.0.0.1]:8090")`)
+Invalid listen target. e.g.
+	[grpc | http | grpcs | https]://[127.0.0.1]:8090
+	[grpc | http | grpcs | https]://[::1]:8090
+	[grpc | http | grpcs | https]+unix:///run/echo.sock
+	mux://127.0.0.1:8090 serves grpc and http on one port`)
 
 	errInvalidDialTarget = errors.New(`
 Invalid dial target. e.g. 	 
-	[grpc | http]://127.0.0.1:8090
+	[grpc | http | grpcs | https]://127.0.0.1:8090
+	[grpc | http | grpcs | https]://[::1]:8090
+	[grpc | http | grpcs | https]+unix:///run/echo.sock
 	etcd://127.0.0.1:2379/echoservice`)
+
+	errListenTLS = errors.New("grpcs:// and https:// targets require option.WithTLS")
+	errDialTLS   = errors.New("TLS dial options require a grpcs:// or https:// target")
+	errMuxTLS    = errors.New("mux:// targets do not support TLS")
 )
 
 type Transport interface {
 	Register(desc trcommon.ServiceDesc, ss interface{})
 	Serve(net.Listener) error
 	Close()
+	Shutdown(ctx context.Context) error
+	Inflight() int64
+	Requests() int64
 }
 
 type Server struct {
 	Transport
-	opts   option.ServerOptions
-	addr   string
-	lis    net.Listener
-	cancel context.CancelFunc
-	startC chan struct{}
+	opts    option.ServerOptions
+	network string
+	addr    string
+	lis     net.Listener
+	cancel  context.CancelFunc
+	startC  chan struct{}
 }
 
+// Addr returns host:port, the address of the host if the server listens on a
+// wildcard addr, or the socket path of a unix domain socket.
 func (s *Server) Addr() string {
 	return s.addr
 }
 
+// Network returns tcp or unix.
+func (s *Server) Network() string {
+	return s.network
+}
+
+// RegisterAddr registers the addr, a unix domain socket is never registered
+// since it is only reachable from the host.
 func (s *Server) RegisterAddr() {
-	if s.opts.Registry != nil {
+	if s.opts.Registry != nil && s.network != "unix" {
 		s.cancel = s.opts.Registry.Register(s.opts.RegistryKey, s.addr)
 	}
 }
 
 func (s *Server) UnregisterAddr() {
-	if s.opts.Registry != nil {
+	s.UnregisterAddrContext(context.Background())
+}
+
+// UnregisterAddrContext removes the addr from the registry and waits for the
+// clients to notice, or until ctx is done.
+func (s *Server) UnregisterAddrContext(ctx context.Context) {
+	if s.opts.Registry != nil && s.cancel != nil {
 		log.Info("unregister")
 		s.cancel()
-		time.Sleep(time.Duration(s.opts.Registry.TTL())*time.Second +
+		t := time.NewTimer(time.Duration(s.opts.Registry.TTL())*time.Second +
 			time.Second)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
 	}
 }
 
@@ -92,35 +126,74 @@ func Listen(target string, opts ...option.ServerOption) (*Server, error) {
 	if len(s) != 2 {
 		return nil, errInvalidListenTarget
 	}
-	proto, addr := s[0], s[1]
-	s = strings.Split(addr, ":")
-	if len(s) != 2 {
+	proto, network, addr := splitUnix(s[0]), "tcp", s[1]
+	bindAddr := addr
+	if proto != s[0] {
+		network = "unix"
+		if addr == "" {
+			return nil, errInvalidListenTarget
+		}
+	} else {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, errInvalidListenTarget
+		}
+		// a wildcard addr, e.g. :8090 which is dual-stack, is bound as is
+		// but registered with an address of the host.
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			addr = util.GetLocalAddr(addr)
+		}
+	}
+
+	// check the options before binding, the master would keep a listener
+	// bound for its workers otherwise.
+	var nextProtos []string
+	switch proto {
+	case "grpc", "http", "mux":
+	case "grpcs":
+		nextProtos = []string{"h2"}
+	case "https":
+		nextProtos = []string{"h2", "http/1.1"}
+	default:
 		return nil, errInvalidListenTarget
 	}
-	ip := s[0]
-	if ip == "" {
-		addr = util.GetLocalAddr(addr)
+	tlsConf, err := ops.ServerTLSConfig(nextProtos...)
+	if err != nil {
+		return nil, err
+	}
+	if proto == "mux" && tlsConf != nil {
+		return nil, errMuxTLS
+	}
+	if (tlsConf != nil) != (nextProtos != nil) {
+		return nil, errListenTLS
 	}
 
 	server := &Server{
-		opts:   ops,
-		addr:   addr,
-		startC: make(chan struct{}),
+		opts:    ops,
+		network: network,
+		addr:    addr,
+		startC:  make(chan struct{}),
 	}
-	if os.Getenv(mwcommon.FORK) == "1" {
-		lis, err := socket.Listen(addr)
-		if err != nil {
-			return nil, err
-		}
-		server.lis = lis
+	// the master binds the listener and passes it to its workers,
+	// workers pick up the inherited one.
+	var lis net.Listener
+	if network == "unix" {
+		lis, err = socket.ListenUnix(bindAddr, ops.SocketMode)
+	} else {
+		lis, err = socket.Listen(bindAddr)
 	}
+	if err != nil {
+		return nil, err
+	}
+	server.lis = lis
+	opts = append(opts, option.WithServerTLSConfig(tlsConf))
 	switch proto {
-	case "grpc":
+	case "grpc", "grpcs":
 		server.Transport = grpctr.New(server.lis, opts...)
-	case "http":
+	case "http", "https":
 		server.Transport = httptr.New(server.lis, opts...)
-	default:
-		return nil, errInvalidListenTarget
+	case "mux":
+		server.Transport = muxtr.New(server.lis, opts...)
 	}
 	return server, nil
 }
@@ -136,13 +209,41 @@ func DialContext(ctx context.Context, target string,
 	if len(s) != 2 {
 		return nil, errInvalidDialTarget
 	}
-	proto, addr := s[0], s[1]
+	proto, addr := splitUnix(s[0]), s[1]
+	if proto != s[0] {
+		if addr == "" {
+			return nil, errInvalidDialTarget
+		}
+		addr = trcommon.UnixPrefix + addr
+	}
+	var ops option.DialOptions
+	for _, o := range opts {
+		o(&ops)
+	}
+	switch proto {
+	case "grpc", "http":
+		if ops.UseTLS() {
+			return nil, errDialTLS
+		}
+	case "grpcs", "https":
+		if !ops.UseTLS() {
+			// the system CAs and the host of addr.
+			opts = append(opts, option.WithTLSConfig(&tls.Config{}))
+		}
+	}
 	switch proto {
-	case "grpc":
+	case "grpc", "grpcs":
 		return grpctr.DialContext(ctx, addr, opts...)
-	case "http":
+	case "http", "https":
 		return httptr.DialContext(ctx, addr, opts...)
 	default:
+		// a resolver target, e.g. etcd://, uses TLS if a TLS option is set.
 		return grpctr.DialContext(ctx, target, opts...)
 	}
 }
+
+// splitUnix strips the +unix suffix of a unix domain socket proto,
+// e.g. grpc+unix.
+func splitUnix(proto string) string {
+	return strings.TrimSuffix(proto, "+unix")
+}
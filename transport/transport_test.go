@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tddhit/box/socket"
+)
+
+func freePort(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	return port
+}
+
+func TestListenWildcard(t *testing.T) {
+	defer socket.Release()
+	port := freePort(t)
+	s, err := Listen("grpc://:" + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	host, p, _ := net.SplitHostPort(s.Addr())
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() || p != port {
+		t.Fatalf("Addr() = %s, want an address of the host", s.Addr())
+	}
+	// bound on every address, not only on the registered one.
+	dials := []string{s.Addr(), net.JoinHostPort("127.0.0.1", port)}
+	if lis, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		lis.Close()
+		dials = append(dials, net.JoinHostPort("::1", port))
+	}
+	for _, addr := range dials {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial %s: %v", addr, err)
+		}
+		c.Close()
+	}
+}
+
+func TestListenInvalidTarget(t *testing.T) {
+	addr := net.JoinHostPort("127.0.0.1", freePort(t))
+	sock := filepath.Join(t.TempDir(), "echo.sock")
+
+	tests := []struct {
+		target string
+		err    error
+	}{
+		{"grpcs://" + addr, errListenTLS},
+		{"https://" + addr, errListenTLS},
+		{"ftp://" + addr, errInvalidListenTarget},
+		{"https+unix://" + sock, errListenTLS},
+		{"grpc:/" + addr, errInvalidListenTarget},
+		{"grpc://127.0.0.1", errInvalidListenTarget},
+		{"grpc+unix://", errInvalidListenTarget},
+	}
+	for _, tt := range tests {
+		if _, err := Listen(tt.target); err != tt.err {
+			t.Errorf("Listen(%q) = %v, want %v", tt.target, err, tt.err)
+		}
+	}
+	// nothing was bound by the failed calls.
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("%s is still bound: %v", addr, err)
+	}
+	lis.Close()
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Fatalf("%s was created: %v", sock, err)
+	}
+}
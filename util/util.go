@@ -2,38 +2,44 @@ package util
 
 import (
 	"net"
-	"strings"
 
 	"github.com/tddhit/tools/log"
 )
 
+// GetLocalAddr returns the port of listenAddr on a private IPv4 address of
+// the host, or on an IPv6 one if the host has no IPv4 address.
 func GetLocalAddr(listenAddr string) string {
-	var host string
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		log.Panic(err)
 	}
+	var host4, host6 string
 	for _, a := range addrs {
-		if ipnet, ok := a.(*net.IPNet); ok &&
-			ipnet.IP.To4() != nil &&
-			!ipnet.IP.IsLoopback() {
-			if isExternalIP(ipnet.IP) {
-				continue
-			} else {
-				host = ipnet.IP.String()
-				break
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || isExternalIP(ipnet.IP) {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			if host4 == "" {
+				host4 = ipnet.IP.String()
 			}
+		} else if host6 == "" && !ipnet.IP.IsLinkLocalUnicast() {
+			// a link-local address needs a zone to be dialed.
+			host6 = ipnet.IP.String()
 		}
 	}
+	host := host4
+	if host == "" {
+		host = host6
+	}
 	if host == "" {
 		log.Panic("no suitable LocalAddr")
 	}
-	s := strings.Split(listenAddr, ":")
-	if len(s) < 2 {
+	_, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
 		log.Panicf("invalid listener:%s", listenAddr)
 	}
-	port := s[len(s)-1]
-	return host + ":" + port
+	return net.JoinHostPort(host, port)
 }
 
 func isExternalIP(IP net.IP) bool {
@@ -57,19 +63,21 @@ func isExternalIP(IP net.IP) bool {
 
 func GetExternalAddr(listenAddr string) string {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		// v6 only
+		conn, err = net.Dial("udp", "[2001:4860:4860::8888]:80")
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer conn.Close()
-	s := strings.Split(conn.LocalAddr().String(), ":")
-	if len(s) < 2 {
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
 		log.Fatalf("invalid localAddr:%s\n", conn.LocalAddr().String())
 	}
-	host := s[0]
-	s = strings.Split(listenAddr, ":")
-	if len(s) < 2 {
+	_, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
 		log.Fatalf("invalid listenAddr:%s\n", listenAddr)
 	}
-	port := s[len(s)-1]
-	return host + ":" + port
+	return net.JoinHostPort(host, port)
 }